@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"app/game"
+)
+
+// 計画できる最長の期間
+const maxAdviceBudget = int64(24 * time.Hour / time.Millisecond)
+
+// 部屋の今の状態で買うものの候補を並べ、budget ミリ秒の計画を立てる。budget が 0 なら計画は立てない
+func roomAdvice(roomName string, budget int64) ([]game.Advice, *game.Plan, error) {
+	r, err := lockRoomStateForRead(roomName)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.mu.Unlock()
+
+	ranking := r.state.Rank()
+	if budget == 0 {
+		return ranking, nil, nil
+	}
+	return ranking, r.state.Plan(budget), nil
+}
+
+// GET /room/{room_name}/advice?budget=<ms> で、次に買うものの候補と budget ミリ秒の購入計画を返す
+func getRoomAdviceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var budget int64
+	if s := query.Get("budget"); s != "" {
+		var err error
+		budget, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || budget < 0 || maxAdviceBudget < budget {
+			http.Error(w, "budget must be between 0 and "+strconv.FormatInt(maxAdviceBudget, 10), 400)
+			return
+		}
+	}
+	enc, err := game.ParseEncoding(query.Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	roomName := mux.Vars(r)["room_name"]
+	ranking, plan, err := roomAdvice(roomName, budget)
+	if err == errRoomNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to advise", "room", roomName, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	b, err := game.EncodeAdvice(ranking, plan, enc)
+	if err != nil {
+		logger.Error("failed to encode advice", "room", roomName, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+func TestGetRoomAdvice(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	assert.Nil(tryAddIsu("adv", big.NewInt(100), getCurrentTime()))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/room/{room_name}/advice", getRoomAdviceHandler)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	var advice struct {
+		Ranking []game.Advice `json:"ranking"`
+		Plan    *game.Plan    `json:"plan"`
+	}
+	w := get("/room/adv/advice")
+	assert.Equal(200, w.Code)
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &advice))
+	assert.Len(advice.Ranking, len(currentItems()))
+	assert.Nil(advice.Plan)
+
+	w = get("/room/adv/advice?budget=5000")
+	assert.Equal(200, w.Code)
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &advice))
+	assert.NotNil(advice.Plan)
+	assert.Equal(int64(5000), advice.Plan.Budget)
+	assert.NotEmpty(advice.Plan.Purchases)
+	for _, p := range advice.Plan.Purchases {
+		assert.True(advice.Plan.Time <= p.Time && p.Time <= advice.Plan.Time+5000)
+	}
+
+	assert.Equal(400, get("/room/adv/advice?budget=-1").Code)
+	assert.Equal(400, get("/room/adv/advice?encoding=hex").Code)
+	assert.Equal(404, get("/room/none/advice").Code)
+	// 無い部屋を読んでもキャッシュや store に部屋は増えない
+	roomStates.Lock()
+	_, ok := roomStates.m["none"]
+	roomStates.Unlock()
+	assert.False(ok)
+	_, ok = store.(*memoryStore).rooms["none"]
+	assert.False(ok)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// JSON では "700ms" のような文字列で書く time.Duration
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	x, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(x)
+	return nil
+}
+
+type DBConfig struct {
+	Host            string   `json:"host" flag:"db-host" env:"ISU_DB_HOST" usage:"MySQL host"`
+	Port            int      `json:"port" flag:"db-port" env:"ISU_DB_PORT" usage:"MySQL port"`
+	User            string   `json:"user" flag:"db-user" env:"ISU_DB_USER" usage:"MySQL user"`
+	Password        string   `json:"password" flag:"db-password" env:"ISU_DB_PASSWORD" usage:"MySQL password"`
+	Name            string   `json:"name" flag:"db-name" env:"ISU_DB_NAME" usage:"MySQL database name"`
+	MaxOpenConns    int      `json:"max_open_conns" flag:"db-max-open-conns" env:"ISU_DB_MAX_OPEN_CONNS" usage:"max open connections to MySQL"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime" flag:"db-conn-max-lifetime" env:"ISU_DB_CONN_MAX_LIFETIME" usage:"max lifetime of a MySQL connection"`
+}
+
+type RedisConfig struct {
+	Host     string `json:"host" flag:"redis-host" env:"ISU_REDIS_HOST" usage:"Redis host"`
+	Port     int    `json:"port" flag:"redis-port" env:"ISU_REDIS_PORT" usage:"Redis port"`
+	Password string `json:"password" flag:"redis-password" env:"ISU_REDIS_PASSWORD" usage:"Redis password"`
+	DB       int    `json:"db" flag:"redis-db" env:"ISU_REDIS_DB" usage:"Redis database number"`
+}
+
+// 設定の優先順位は 既定値 < 設定ファイル < 環境変数 < コマンドライン引数
+type Config struct {
+	DB    DBConfig    `json:"db"`
+	Redis RedisConfig `json:"redis"`
+
+	// mysql なら MySQL と Redis、memory ならプロセス内に部屋を持つ
+	Store            string   `json:"store" flag:"store" env:"ISU_STORE" usage:"room store: mysql or memory"`
+	Listen           string   `json:"listen" flag:"listen" env:"ISU_LISTEN" usage:"address to listen on"`
+	Items            string   `json:"items" flag:"items" env:"ISU_ITEMS" usage:"item master: builtin, db (m_item table) or a path to a JSON or YAML file"`
+	Rulesets         string   `json:"rulesets" flag:"rulesets" env:"ISU_RULESETS" usage:"path to a JSON or YAML file of rulesets rooms can be created with"`
+	ItemMemoSize     int      `json:"item_memo_size" flag:"item-memo-size" env:"ISU_ITEM_MEMO_SIZE" usage:"number of powers and prices to remember per item beyond the precomputed ones"`
+	PublicDir        string   `json:"public_dir" flag:"public-dir" env:"ISU_PUBLIC_DIR" usage:"directory of static files"`
+	RoomTick         Duration `json:"room_tick" flag:"room-tick" env:"ISU_ROOM_TICK" usage:"interval to refresh the shared status of a room"`
+	PushInterval     Duration `json:"push_interval" flag:"push-interval" env:"ISU_PUSH_INTERVAL" usage:"interval to push the status to each client"`
+	StatusHorizon    Duration `json:"status_horizon" flag:"status-horizon" env:"ISU_STATUS_HORIZON" usage:"default look-ahead of a room status"`
+	MaxStatusHorizon Duration `json:"max_status_horizon" flag:"max-status-horizon" env:"ISU_MAX_STATUS_HORIZON" usage:"longest look-ahead a room or a client can ask for"`
+	SnapshotInterval int      `json:"snapshot_interval" flag:"snapshot-interval" env:"ISU_SNAPSHOT_INTERVAL" usage:"number of events between room snapshots"`
+	SellRefund       int      `json:"sell_refund" flag:"sell-refund" env:"ISU_SELL_REFUND" usage:"percentage of an item's price refunded when it is sold"`
+	AdminToken       string   `json:"admin_token" flag:"admin-token" env:"ISU_ADMIN_TOKEN" usage:"bearer token required by the /admin endpoints, which are disabled when it is empty"`
+	ShutdownTimeout  Duration `json:"shutdown_timeout" flag:"shutdown-timeout" env:"ISU_SHUTDOWN_TIMEOUT" usage:"how long to wait for connections to drain on SIGTERM"`
+	LogLevel         string   `json:"log_level" flag:"log-level" env:"ISU_LOG_LEVEL" usage:"log level: debug, info, warn or error"`
+	LogFormat        string   `json:"log_format" flag:"log-format" env:"ISU_LOG_FORMAT" usage:"log format: text or json"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DB: DBConfig{
+			Host:            "127.0.0.1",
+			Port:            3306,
+			User:            "root",
+			Name:            "isudb",
+			MaxOpenConns:    20,
+			ConnMaxLifetime: Duration(5 * time.Minute),
+		},
+		Redis: RedisConfig{
+			Host: "127.0.0.1",
+			Port: 6379,
+		},
+		Store:            "mysql",
+		Listen:           ":5000",
+		Items:            "builtin",
+		ItemMemoSize:     1024,
+		PublicDir:        "../public/",
+		RoomTick:         Duration(700 * time.Millisecond),
+		PushInterval:     Duration(500 * time.Millisecond),
+		StatusHorizon:    Duration(time.Second),
+		MaxStatusHorizon: Duration(time.Minute),
+		SnapshotInterval: 100,
+		SellRefund:       50,
+		ShutdownTimeout:  Duration(10 * time.Second),
+		LogLevel:         "info",
+		LogFormat:        "text",
+	}
+}
+
+// 今の設定。ルームの goroutine などから読まれるので、書き換えは setConfig で丸ごと差し替える
+var config atomic.Value // Config
+
+func init() {
+	setConfig(defaultConfig())
+}
+
+func currentConfig() Config {
+	return config.Load().(Config)
+}
+
+func setConfig(c Config) {
+	config.Store(c)
+}
+
+func (c *Config) Validate() error {
+	switch c.Store {
+	case "mysql", "memory":
+	default:
+		return fmt.Errorf("store must be mysql or memory: %q", c.Store)
+	}
+	if c.Store == "mysql" {
+		if c.DB.Host == "" || c.DB.Name == "" || c.DB.User == "" {
+			return fmt.Errorf("db host, name and user are required")
+		}
+		if c.DB.Port <= 0 || 65535 < c.DB.Port {
+			return fmt.Errorf("invalid db port: %d", c.DB.Port)
+		}
+		if c.DB.MaxOpenConns <= 0 {
+			return fmt.Errorf("db max_open_conns must be positive")
+		}
+		if c.DB.ConnMaxLifetime < 0 {
+			return fmt.Errorf("db conn_max_lifetime must not be negative")
+		}
+		if c.Redis.Host == "" {
+			return fmt.Errorf("redis host is required")
+		}
+		if c.Redis.Port <= 0 || 65535 < c.Redis.Port {
+			return fmt.Errorf("invalid redis port: %d", c.Redis.Port)
+		}
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if c.Items == "" {
+		return fmt.Errorf("items is required")
+	}
+	if c.Items == "db" && c.Store != "mysql" {
+		return fmt.Errorf("items db requires store mysql")
+	}
+	if c.ItemMemoSize < 0 {
+		return fmt.Errorf("item_memo_size must not be negative")
+	}
+	if c.PublicDir == "" {
+		return fmt.Errorf("public_dir is required")
+	}
+	if c.RoomTick <= 0 || c.PushInterval <= 0 {
+		return fmt.Errorf("room_tick and push_interval must be positive")
+	}
+	if c.StatusHorizon < Duration(time.Millisecond) || c.MaxStatusHorizon < c.StatusHorizon {
+		return fmt.Errorf("status_horizon must be at least 1ms and not exceed max_status_horizon")
+	}
+	if c.SnapshotInterval <= 0 {
+		return fmt.Errorf("snapshot_interval must be positive")
+	}
+	if c.SellRefund < 0 || 100 < c.SellRefund {
+		return fmt.Errorf("sell_refund must be between 0 and 100")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return fmt.Errorf("invalid log_level: %q", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("log_format must be text or json: %q", c.LogFormat)
+	}
+	return nil
+}
+
+// パスワードを伏せて JSON で書き出す
+func (c Config) Print(w io.Writer) error {
+	if c.DB.Password != "" {
+		c.DB.Password = "********"
+	}
+	if c.Redis.Password != "" {
+		c.Redis.Password = "********"
+	}
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// flag, env タグの付いた Config のフィールド
+type configVar struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *Config) reflect.Value
+}
+
+func configVars() []configVar {
+	var vars []configVar
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			idx := append(append([]int{}, index...), i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, idx)
+				continue
+			}
+			vars = append(vars, configVar{
+				flag:  f.Tag.Get("flag"),
+				env:   f.Tag.Get("env"),
+				usage: f.Tag.Get("usage"),
+				field: func(c *Config) reflect.Value {
+					return reflect.ValueOf(c).Elem().FieldByIndex(idx)
+				},
+			})
+		}
+	}
+	walk(reflect.TypeOf(Config{}), nil)
+	return vars
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(s)
+	case int:
+		x, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(x))
+	case Duration:
+		x, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(x))
+	default:
+		return fmt.Errorf("unsupported config type %s", v.Type())
+	}
+	return nil
+}
+
+func formatConfigValue(v reflect.Value) string {
+	if d, ok := v.Interface().(Duration); ok {
+		return time.Duration(d).String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// 既定値に設定ファイル、環境変数、コマンドライン引数を順に重ねた設定を返す。
+// 設定ファイルは -config か ISU_CONFIG で指定する。残りの引数も返す
+func loadConfig(args []string, getenv func(string) string) (Config, bool, []string, error) {
+	vars := configVars()
+	defaults := defaultConfig()
+
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	configPath := fs.String("config", getenv("ISU_CONFIG"), "path to a JSON config file")
+	printConfig := fs.Bool("print-config", false, "print the config and exit")
+	flagValues := map[string]*string{}
+	varsByFlag := map[string]configVar{}
+	for _, v := range vars {
+		flagValues[v.flag] = fs.String(v.flag, formatConfigValue(v.field(&defaults)), v.usage+" (env "+v.env+")")
+		varsByFlag[v.flag] = v
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, false, nil, err
+	}
+
+	c := defaultConfig()
+	if *configPath != "" {
+		b, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, false, nil, err
+		}
+		if err := json.Unmarshal(b, &c); err != nil {
+			return Config{}, false, nil, fmt.Errorf("%s: %v", *configPath, err)
+		}
+	}
+
+	for _, v := range vars {
+		if s := getenv(v.env); s != "" {
+			if err := setConfigValue(v.field(&c), s); err != nil {
+				return Config{}, false, nil, fmt.Errorf("%s: %v", v.env, err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		v, ok := varsByFlag[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if e := setConfigValue(v.field(&c), *flagValues[f.Name]); e != nil {
+			err = fmt.Errorf("-%s: %v", f.Name, e)
+		}
+	})
+	if err != nil {
+		return Config{}, false, nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, false, nil, err
+	}
+	return c, *printConfig, fs.Args(), nil
+}
+
+func mustLoadConfig() []string {
+	c, printConfig, args, err := loadConfig(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if printConfig {
+		c.Print(os.Stdout)
+		os.Exit(0)
+	}
+	setConfig(c)
+	return args
+}
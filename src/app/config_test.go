@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := ioutil.TempFile("", "config")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"db": {"host": "db.local", "port": 13306}, "listen": ":8080", "room_tick": "1s"}`)
+	f.Close()
+
+	env := map[string]string{
+		"ISU_CONFIG":        f.Name(),
+		"ISU_DB_PORT":       "23306",
+		"ISU_PUBLIC_DIR":    "/srv/public",
+		"ISU_REDIS_DB":      "",
+		"ISU_PUSH_INTERVAL": "250ms",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	c, printConfig, args, err := loadConfig([]string{"-public-dir", "/tmp/public", "--print-config", "migrate", "up"}, getenv)
+	assert.Nil(err)
+	assert.True(printConfig)
+	assert.Equal([]string{"migrate", "up"}, args)
+
+	assert.Equal("db.local", c.DB.Host)
+	assert.Equal(23306, c.DB.Port)
+	assert.Equal("isudb", c.DB.Name)
+	assert.Equal(":8080", c.Listen)
+	assert.Equal("/tmp/public", c.PublicDir)
+	assert.Equal(Duration(time.Second), c.RoomTick)
+	assert.Equal(Duration(250*time.Millisecond), c.PushInterval)
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	assert := assert.New(t)
+	getenv := func(key string) string { return "" }
+
+	_, _, _, err := loadConfig([]string{"-store", "sqlite"}, getenv)
+	assert.NotNil(err)
+	_, _, _, err = loadConfig([]string{"-db-port", "x"}, getenv)
+	assert.NotNil(err)
+	_, _, _, err = loadConfig([]string{"-push-interval", "0s"}, getenv)
+	assert.NotNil(err)
+
+	c, _, _, err := loadConfig([]string{"-store", "memory", "-db-host", ""}, getenv)
+	assert.Nil(err)
+	assert.Equal(defaultConfig().DB.Port, c.DB.Port)
+}
+
+// f で書き換えた設定に差し替え、元に戻す関数を返す
+func overrideConfig(f func(c *Config)) func() {
+	old := currentConfig()
+	c := old
+	f(&c)
+	setConfig(c)
+	return func() { setConfig(old) }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+const (
+	eventIsuAdded   = "IsuAdded"
+	eventItemBought = "ItemBought"
+	eventItemSold   = "ItemSold"
+	eventRoomReset  = "RoomReset"
+	eventHorizonSet = "HorizonSet"
+	eventRulesetSet = "RulesetSet"
+)
+
+// 他のプロセスが先に同じ部屋のイベントを追記していた
+var errEventConflict = errors.New("event conflict")
+
+// 部屋に対して受理された操作。部屋ごとに seq の順で追記される
+type RoomEvent struct {
+	RoomName  string `json:"-" db:"room_name"`
+	Seq       int64  `json:"seq" db:"seq"`
+	Type      string `json:"type" db:"type"`
+	Time      int64  `json:"time" db:"time"` // 効果が出る時刻
+	Isu       string `json:"isu,omitempty" db:"isu"`
+	ItemID    int    `json:"item_id,omitempty" db:"item_id"`
+	Ordinal   int    `json:"ordinal,omitempty" db:"ordinal"`
+	Horizon   int64  `json:"horizon,omitempty" db:"horizon"` // HorizonSet で設定する先読みのミリ秒数
+	Ruleset   string `json:"ruleset,omitempty" db:"ruleset"` // RulesetSet で設定する roomRuleset の JSON。空なら既定のルール
+	CreatedAt int64  `json:"created_at" db:"created_at"`     // 受理した時の部屋の時刻
+}
+
+// seq までのイベントを反映した部屋の状態
+type RoomSnapshot struct {
+	RoomName string `db:"room_name"`
+	Seq      int64  `db:"seq"`
+	Time     int64  `db:"time"`
+	State    string `db:"state"` // roomStateSnapshot の JSON
+}
+
+// 部屋ごとの追記専用のイベントログとスナップショットの保存先。
+// 部屋の状態はイベントログだけから作る
+type EventLog interface {
+	// 部屋の最後の seq が afterSeq のときだけイベントを順に追記し、最後に振られた seq を返す。
+	// 違えば errEventConflict を返す。失敗したら 1 件も追記しない
+	Append(roomName string, afterSeq int64, es ...RoomEvent) (int64, error)
+	// seq が afterSeq より大きいイベントを seq の順に返す
+	Events(roomName string, afterSeq int64) ([]RoomEvent, error)
+	SaveSnapshot(snap RoomSnapshot) error
+	// 最新のスナップショットを返す。無ければ nil
+	LatestSnapshot(roomName string) (*RoomSnapshot, error)
+	// 全ての部屋を時刻 t にリセットしたことを記録する
+	MarkReset(t int64) error
+	// 最後に全ての部屋をリセットした時刻を返す。無ければ 0
+	LastReset() (int64, error)
+}
+
+var eventLog EventLog
+
+// 最新のスナップショットとそれ以降のイベントから部屋の状態を作る。
+// イベントログに部屋が無ければ nil を返す
+func rebuildRoomState(roomName string) (*roomState, error) {
+	snap, err := eventLog.LatestSnapshot(roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	var s *roomState
+	var afterSeq int64
+	if snap != nil {
+		s, err = restoreRoomState(currentItems(), snap)
+		if err != nil {
+			return nil, err
+		}
+		afterSeq = snap.Seq
+	}
+
+	events, err := eventLog.Events(roomName, afterSeq)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		if len(events) == 0 {
+			return nil, nil
+		}
+		s = newRoomState(currentItems(), 0)
+	}
+	for _, e := range events {
+		s.apply(e)
+	}
+	return s, nil
+}
+
+// 反映済みの操作をイベントログに追記し、必要ならスナップショットを取る。
+// 追記に失敗したら、反映した分を捨ててイベントログから読み直すようにしてエラーを返す。
+// 他のプロセスが先に追記していれば errEventConflict になり、次の操作はそのイベントを読んだ上で検証する。
+// スナップショットは後で取り直せるので、失敗してもログに残すだけにする
+func (r *cachedRoom) record(roomName string, es ...RoomEvent) error {
+	// 既定のルールの部屋も、最初のイベントの前に使っているアイテムを残しておく
+	var rs *roomRuleset
+	if r.state.seq == 0 && r.state.ruleset == nil && es[0].Type != eventRulesetSet {
+		rs = defaultRoomRuleset(r.state.Items())
+		b, err := json.Marshal(rs)
+		if err != nil {
+			r.state = nil
+			return err
+		}
+		es = append([]RoomEvent{{Type: eventRulesetSet, Ruleset: string(b), CreatedAt: es[0].CreatedAt}}, es...)
+	}
+
+	seq, err := eventLog.Append(roomName, r.state.seq, es...)
+	if err != nil {
+		r.state = nil
+		return err
+	}
+	last := es[len(es)-1]
+	if rs != nil {
+		r.state.ruleset = rs
+	}
+	r.state.seq = seq
+	r.state.updatedAt = last.CreatedAt
+
+	if last.Type != eventRoomReset && seq-r.state.snapshotSeq < int64(currentConfig().SnapshotInterval) {
+		return nil
+	}
+	snap, err := r.state.snapshot(roomName)
+	if err == nil {
+		err = eventLog.SaveSnapshot(snap)
+	}
+	if err != nil {
+		logger.Error("failed to save snapshot", "room", roomName, "seq", seq, "err", err)
+		return nil
+	}
+	r.state.snapshotSeq = seq
+	return nil
+}
+
+// プロセス内で完結する EventLog
+type memoryEventLog struct {
+	mu        sync.Mutex
+	events    map[string][]RoomEvent
+	snapshots map[string]RoomSnapshot
+	lastReset int64
+}
+
+func newMemoryEventLog() *memoryEventLog {
+	return &memoryEventLog{
+		events:    map[string][]RoomEvent{},
+		snapshots: map[string]RoomSnapshot{},
+	}
+}
+
+func (l *memoryEventLog) Append(roomName string, afterSeq int64, es ...RoomEvent) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if int64(len(l.events[roomName])) != afterSeq {
+		return 0, errEventConflict
+	}
+	for _, e := range es {
+		e.RoomName = roomName
+		e.Seq = int64(len(l.events[roomName])) + 1
+		l.events[roomName] = append(l.events[roomName], e)
+	}
+	return int64(len(l.events[roomName])), nil
+}
+
+func (l *memoryEventLog) Events(roomName string, afterSeq int64) ([]RoomEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	events := l.events[roomName]
+	if afterSeq >= int64(len(events)) {
+		return []RoomEvent{}, nil
+	}
+	result := make([]RoomEvent, len(events)-int(afterSeq))
+	copy(result, events[afterSeq:])
+	return result, nil
+}
+
+func (l *memoryEventLog) SaveSnapshot(snap RoomSnapshot) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cur, ok := l.snapshots[snap.RoomName]; ok && cur.Seq > snap.Seq {
+		return nil
+	}
+	l.snapshots[snap.RoomName] = snap
+	return nil
+}
+
+func (l *memoryEventLog) LatestSnapshot(roomName string) (*RoomSnapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	snap, ok := l.snapshots[roomName]
+	if !ok {
+		return nil, nil
+	}
+	return &snap, nil
+}
+
+func (l *memoryEventLog) MarkReset(t int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lastReset < t {
+		l.lastReset = t
+	}
+	return nil
+}
+
+func (l *memoryEventLog) LastReset() (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastReset, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mysqlErrDupEntry = 1062
+	mysqlErrDeadlock = 1213
+)
+
+// room_event, room_snapshot, room_reset テーブルを使う EventLog
+type mysqlEventLog struct {
+	db *sqlx.DB
+}
+
+func newMySQLEventLog(db *sqlx.DB) *mysqlEventLog {
+	return &mysqlEventLog{db: db}
+}
+
+func (l *mysqlEventLog) Append(roomName string, afterSeq int64, es ...RoomEvent) (int64, error) {
+	tx, err := l.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+
+	var seq int64
+	err = tx.Get(&seq, "SELECT COALESCE(MAX(seq), 0) FROM room_event WHERE room_name = ? FOR UPDATE", roomName)
+	if err != nil {
+		tx.Rollback()
+		return 0, appendError(err)
+	}
+	if seq != afterSeq {
+		tx.Rollback()
+		return 0, errEventConflict
+	}
+	for _, e := range es {
+		seq++
+		e.RoomName = roomName
+		e.Seq = seq
+		_, err = tx.NamedExec("INSERT INTO room_event(room_name, seq, type, time, isu, item_id, ordinal, horizon, ruleset, created_at) "+
+			"VALUES (:room_name, :seq, :type, :time, :isu, :item_id, :ordinal, :horizon, :ruleset, :created_at)", e)
+		if err != nil {
+			tx.Rollback()
+			return 0, appendError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, appendError(err)
+	}
+	return seq, nil
+}
+
+// まだイベントの無い部屋は FOR UPDATE で行をロックできないので、同時に追記すると
+// 主キーの重複かデッドロックになる。どちらも先に追記されたのと同じに扱う
+func appendError(err error) error {
+	if e, ok := err.(*mysql.MySQLError); ok && (e.Number == mysqlErrDupEntry || e.Number == mysqlErrDeadlock) {
+		return errEventConflict
+	}
+	return err
+}
+
+func (l *mysqlEventLog) Events(roomName string, afterSeq int64) ([]RoomEvent, error) {
+	events := []RoomEvent{}
+	err := l.db.Select(&events, "SELECT * FROM room_event WHERE room_name = ? AND seq > ? ORDER BY seq", roomName, afterSeq)
+	return events, err
+}
+
+func (l *mysqlEventLog) SaveSnapshot(snap RoomSnapshot) error {
+	_, err := l.db.NamedExec("INSERT INTO room_snapshot(room_name, seq, time, state) "+
+		"VALUES (:room_name, :seq, :time, :state) ON DUPLICATE KEY UPDATE state = VALUES(state)", snap)
+	return err
+}
+
+func (l *mysqlEventLog) LatestSnapshot(roomName string) (*RoomSnapshot, error) {
+	var snap RoomSnapshot
+	err := l.db.Get(&snap, "SELECT * FROM room_snapshot WHERE room_name = ? ORDER BY seq DESC LIMIT 1", roomName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (l *mysqlEventLog) MarkReset(t int64) error {
+	_, err := l.db.Exec("INSERT IGNORE INTO room_reset(time) VALUES (?)", t)
+	return err
+}
+
+func (l *mysqlEventLog) LastReset() (int64, error) {
+	var t int64
+	err := l.db.Get(&t, "SELECT COALESCE(MAX(time), 0) FROM room_reset")
+	return t, err
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+// スナップショットと残りのイベントから作り直した状態が元の状態と一致する
+func TestRebuildRoomState(t *testing.T) {
+	assert := assert.New(t)
+
+	eventLog = newMemoryEventLog()
+	r := &cachedRoom{state: newRoomState(currentItems(), 0)}
+
+	add := func(time int64, isu string) {
+		r.state.AddIsu(time, game.Str2Big(isu))
+		r.record("a", RoomEvent{Type: eventIsuAdded, Time: time, Isu: isu})
+	}
+	buy := func(itemID, ordinal int, time int64) {
+		r.state.Buy(game.Buying{ItemID: itemID, Ordinal: ordinal, Time: time})
+		r.record("a", RoomEvent{Type: eventItemBought, Time: time, ItemID: itemID, Ordinal: ordinal})
+	}
+
+	add(0, "1")
+	r.state.replace(newRoomState(currentItems(), 10))
+	r.record("a", RoomEvent{Type: eventRoomReset, Time: 10})
+	r.state.horizon = 2000
+	r.record("a", RoomEvent{Type: eventHorizonSet, Time: 10, Horizon: 2000})
+	for i := 0; i < currentConfig().SnapshotInterval+10; i++ {
+		add(int64(10+i*10), "1000")
+		r.state.Advance(int64(10 + i*10))
+	}
+	buy(1, 1, 2000)
+	buy(1, 2, 2001)
+	add(2500, "12345678901234567890")
+
+	snap, err := eventLog.LatestSnapshot("a")
+	assert.Nil(err)
+	assert.NotNil(snap)
+	events, err := eventLog.Events("a", snap.Seq)
+	assert.Nil(err)
+	assert.NotEmpty(events)
+
+	rebuilt, err := rebuildRoomState("a")
+	assert.Nil(err)
+	assert.Equal(r.state.seq, rebuilt.seq)
+	assert.Equal(int64(2000), rebuilt.horizon)
+
+	r.state.Advance(3000)
+	rebuilt.Advance(3000)
+	assert.Equal(r.state.status(), rebuilt.status())
+
+	none, err := rebuildRoomState("b")
+	assert.Nil(err)
+	assert.Nil(none)
+}
+
+// 追記できないイベントログ
+type failingEventLog struct {
+	EventLog
+}
+
+func (failingEventLog) Append(roomName string, afterSeq int64, es ...RoomEvent) (int64, error) {
+	return 0, errors.New("append failed")
+}
+
+// 追記できなければ操作を受け付けずに元に戻し、store にも書かない
+func TestRecordFailure(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	r, err := lockRoomState("f", getCurrentTime())
+	assert.Nil(err)
+	r.mu.Unlock()
+
+	eventLog = failingEventLog{eventLog}
+	defer useMemoryBackends()
+
+	assert.NotNil(trySetHorizon("f", 2000))
+	rs := &roomRuleset{Name: "fast", Speed: 2}
+	rulesets.Lock()
+	old := rulesets.m
+	rulesets.m = map[string]*roomRuleset{"fast": rs}
+	rulesets.Unlock()
+	defer func() {
+		rulesets.Lock()
+		rulesets.m = old
+		rulesets.Unlock()
+	}()
+	assert.NotNil(setRoomRuleset("f", "fast"))
+
+	r, err = lockRoomState("f", getCurrentTime())
+	assert.Nil(err)
+	assert.Equal(int64(0), r.state.horizon)
+	assert.Nil(r.state.ruleset)
+	r.mu.Unlock()
+
+	assert.NotNil(tryAddIsu("f", big.NewInt(1), getCurrentTime()+1000))
+	addings, err := store.LoadAddings("f")
+	assert.Nil(err)
+	assert.Empty(addings)
+}
+
+// イベントログができる前の store の履歴は、最初に読み込んだときにイベントログに移す
+func TestSeedRoomStateFromStore(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	assert.Nil(store.AddIsu("s", 0, big.NewInt(100)))
+	assert.Nil(store.InsertBuying("s", game.Buying{RoomName: "s", ItemID: 1, Ordinal: 1, Time: 0}))
+	assert.Nil(store.InsertBuying("s", game.Buying{RoomName: "s", ItemID: 1, Ordinal: 2, Time: 0}))
+	assert.Nil(store.InsertSelling("s", game.Selling{RoomName: "s", ItemID: 1, Ordinal: 2, Time: 0, Refund: "0"}))
+
+	currentTime := getCurrentTime()
+	r, err := lockRoomState("s", currentTime)
+	assert.Nil(err)
+	expected := r.state.MilliIsuAt(currentTime + 1000)
+	r.mu.Unlock()
+	assert.Nil(tryAddIsu("s", big.NewInt(1), currentTime+1000))
+	expected.Add(expected, big.NewInt(1000))
+
+	// キャッシュを捨てても store の履歴と新しい操作の両方が残る
+	roomStates.Lock()
+	roomStates.m = map[string]*cachedRoom{}
+	roomStates.Unlock()
+	r, err = lockRoomState("s", currentTime)
+	assert.Nil(err)
+	assert.Equal(expected, r.state.MilliIsuAt(currentTime+1000))
+	assert.Equal(1, r.state.CountBought(1))
+	r.mu.Unlock()
+
+	events, err := eventLog.Events("s", 0)
+	assert.Nil(err)
+	assert.Len(events, 6)
+}
+
+// resetRoomStates は部屋ごとに追記せず、次に読み込んだときに RoomReset を追記する
+func TestLazyRoomReset(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	assert.Nil(tryAddIsu("z", big.NewInt(100), getCurrentTime()+1000))
+	resetTime := getCurrentTime() + 1
+	assert.Nil(resetRoomStates(resetTime))
+
+	events, err := eventLog.Events("z", 0)
+	assert.Nil(err)
+	assert.Len(events, 2)
+
+	r, err := lockRoomState("z", resetTime)
+	assert.Nil(err)
+	assert.False(r.state.started)
+	assert.Equal(0, r.state.MilliIsuAt(resetTime+1000).Sign())
+	r.mu.Unlock()
+
+	events, err = eventLog.Events("z", 0)
+	assert.Nil(err)
+	assert.Len(events, 3)
+	assert.Equal(eventRoomReset, events[2].Type)
+	assert.Equal(resetTime, events[2].CreatedAt)
+}
+
+// 同じイベントログを使う他のプロセスの操作とリセットは、次の操作の前に反映する。
+// 古い状態のまま追記しようとすると errEventConflict になる
+func TestOtherProcessEvents(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	currentTime := getCurrentTime()
+	assert.Nil(tryAddIsu("m", big.NewInt(100), currentTime+1000))
+
+	// 他のプロセスのキャッシュ
+	other := &cachedRoom{}
+	assert.Nil(other.refresh("m", currentTime))
+	stale := &cachedRoom{}
+	assert.Nil(stale.refresh("m", currentTime))
+
+	other.state.AddIsu(currentTime+2000, big.NewInt(5))
+	assert.Nil(other.record("m", RoomEvent{Type: eventIsuAdded, Time: currentTime + 2000, Isu: "5", CreatedAt: currentTime}))
+
+	r, err := lockRoomState("m", currentTime)
+	assert.Nil(err)
+	assert.Equal(other.state.seq, r.state.seq)
+	assert.Equal(other.state.MilliIsuAt(currentTime+3000), r.state.MilliIsuAt(currentTime+3000))
+	r.mu.Unlock()
+
+	stale.state.AddIsu(currentTime+2000, big.NewInt(7))
+	err = stale.record("m", RoomEvent{Type: eventIsuAdded, Time: currentTime + 2000, Isu: "7", CreatedAt: currentTime})
+	assert.Equal(errEventConflict, err)
+	assert.Nil(stale.state)
+	assert.Equal(reasonConflict, actionRejectReason(err))
+
+	// 他のプロセスで受け付けた /initialize
+	resetTime := currentTime + 1
+	assert.Nil(eventLog.MarkReset(resetTime))
+	r, err = lockRoomState("m", resetTime)
+	assert.Nil(err)
+	assert.False(r.state.started)
+	assert.Equal(0, r.state.MilliIsuAt(resetTime+1000).Sign())
+	r.mu.Unlock()
+}
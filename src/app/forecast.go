@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"app/game"
+)
+
+// 部屋の今の状態から、各アイテムの次の ordinals 個が買えるようになる時刻を求める
+func roomForecast(roomName string, ordinals int) (*game.Forecast, error) {
+	ordinals, err := catalogOrdinals(ordinals)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := lockRoomStateForRead(roomName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.mu.Unlock()
+	return r.state.Forecast(ordinals), nil
+}
+
+// GET /room/{room_name}/forecast?ordinals=K で、WebSocket の getForecast と同じものを返す
+func getRoomForecastHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ordinals, err := parseCatalogOrdinals(query.Get("ordinals"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	enc, err := game.ParseEncoding(query.Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	roomName := mux.Vars(r)["room_name"]
+	forecast, err := roomForecast(roomName, ordinals)
+	if err == errRoomNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to forecast", "room", roomName, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	b, err := forecast.Encode(enc)
+	if err != nil {
+		logger.Error("failed to encode forecast", "room", roomName, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+func TestGetRoomForecast(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	assert.Nil(tryAddIsu("f", big.NewInt(1000), getCurrentTime()+100))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/room/{room_name}/forecast", getRoomForecastHandler)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/room/f/forecast?ordinals=2")
+	assert.Equal(200, w.Code)
+	var forecast game.Forecast
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &forecast))
+	assert.Len(forecast.Items, len(currentItems())*2)
+	for _, a := range forecast.Items {
+		item := currentItems()[a.ItemID]
+		total := new(big.Int)
+		for o := 1; o <= a.Ordinal; o++ {
+			total.Add(total, item.GetPrice(o))
+		}
+		if total.Cmp(big.NewInt(1000)) <= 0 {
+			// 予約した addIsu の時刻に買えるようになる
+			assert.True(forecast.Time <= a.Time && a.Time <= forecast.Time+100, "item %d", a.ItemID)
+		} else {
+			assert.Equal(int64(-1), a.Time, "item %d", a.ItemID)
+		}
+	}
+
+	// WebSocket と同じく 0 は既定の個数
+	w = get("/room/f/forecast?ordinals=0")
+	assert.Equal(200, w.Code)
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &forecast))
+	assert.Len(forecast.Items, len(currentItems())*defaultCatalogOrdinals)
+	assert.Equal(400, get("/room/f/forecast?ordinals=-1").Code)
+	assert.Equal(400, get("/room/f/forecast?ordinals=1000").Code)
+	assert.Equal(400, get("/room/f/forecast?encoding=hex").Code)
+
+	// 読むだけなので部屋の時計は進めず、何も無い部屋は 404 になる
+	assert.Equal(404, get("/room/none/forecast?ordinals=1").Code)
+	_, ok := roomClock.(*memoryClock).times["none"]
+	assert.False(ok)
+	// 無い部屋を読んでもキャッシュや store に部屋は増えない
+	roomStates.Lock()
+	_, ok = roomStates.m["none"]
+	roomStates.Unlock()
+	assert.False(ok)
+	_, ok = store.(*memoryStore).rooms["none"]
+	assert.False(ok)
+}
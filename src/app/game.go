@@ -2,23 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math"
 	"math/big"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-redis/redis"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/websocket"
-	"github.com/jmoiron/sqlx"
 	"golang.org/x/sync/singleflight"
+
+	"app/game"
 )
 
 var big1000 = big.NewInt(1000)
 
-const duration = 700 * time.Millisecond
+// buyItems で1度に買える最大の個数
+const maxBuyItems = 1000
 
 var group singleflight.Group
 var rooms sync.Map
@@ -36,583 +38,433 @@ type GameRequest struct {
 	// for addIsu
 	Isu string `json:"isu"`
 
-	// for buyItem
+	// for buyItem, buyItems, sellItem
 	ItemID      int `json:"item_id"`
 	CountBought int `json:"count_bought"`
-}
-
-type GameResponse struct {
-	RequestID int  `json:"request_id"`
-	IsSuccess bool `json:"is_success"`
-}
-
-// 10進数の指数表記に使うデータ。JSONでは [仮数部, 指数部] という2要素配列になる。
-type Exponential struct {
-	// Mantissa * 10 ^ Exponent
-	Mantissa int64
-	Exponent int64
-}
-
-func (n Exponential) MarshalJSON() ([]byte, error) {
-	bufmat := FormatInt(n.Mantissa)
-	bufexp := FormatInt(n.Exponent)
-	lmat := len(bufmat)
-	lexp := len(bufexp)
-	result := make([]byte, lmat+3+lexp)
-	result[0] = '['
-	copy(result[1:lmat+1], bufmat)
-	result[lmat+1] = ','
-	copy(result[lmat+2:len(result)-1], bufexp)
-	result[len(result)-1] = ']'
-	return result, nil
-}
-
-type Adding struct {
-	RoomName string `json:"-" db:"room_name"`
-	Time     int64  `json:"time" db:"time"`
-	Isu      string `json:"isu" db:"isu"`
-}
-
-type Buying struct {
-	RoomName string `db:"room_name"`
-	ItemID   int    `db:"item_id"`
-	Ordinal  int    `db:"ordinal"`
-	Time     int64  `db:"time"`
-}
-
-type Schedule struct {
-	Time       int64       `json:"time"`
-	MilliIsu   Exponential `json:"milli_isu"`
-	TotalPower Exponential `json:"total_power"`
-}
 
-type Item struct {
-	ItemID      int         `json:"item_id"`
-	CountBought int         `json:"count_bought"`
-	CountBuilt  int         `json:"count_built"`
-	NextPrice   Exponential `json:"next_price"`
-	Power       Exponential `json:"power"`
-	Building    []Building  `json:"building"`
-}
+	// for buyItems。Items が空なら ItemID を CountBought+1 個目から Count 個買う
+	Count      int        `json:"count"`
+	Items      []BuyOrder `json:"items"`
+	BestEffort bool       `json:"best_effort"` // 買えるところまで買う。false なら全部買えるときだけ買う
 
-type OnSale struct {
-	ItemID int   `json:"item_id"`
-	Time   int64 `json:"time"`
-}
+	// for getStatus, setHorizon (ミリ秒)
+	Horizon int64 `json:"horizon"`
 
-type Building struct {
-	Time       int64       `json:"time"`
-	CountBuilt int         `json:"count_built"`
-	Power      Exponential `json:"power"`
-}
+	// for getItems, getForecast
+	Ordinals int `json:"ordinals"`
 
-type GameStatus struct {
-	Time     int64      `json:"time"`
-	Adding   []Adding   `json:"adding"`
-	Schedule []Schedule `json:"schedule"`
-	Items    []Item     `json:"items"`
-	OnSale   []OnSale   `json:"on_sale"`
+	// for setEncoding
+	Encoding string `json:"encoding"`
 }
 
-func str2big(s string) *big.Int {
-	x := new(big.Int)
-	x.SetString(s, 10)
-	return x
+// getItems に対して GameResponse の前に返す、部屋で使っているアイテムの一覧。
+// Catalog は接続の Encoding で書いた game.Catalog
+type CatalogMessage struct {
+	Catalog json.RawMessage `json:"catalog"`
 }
 
-// 桁数が増えても大丈夫なBigintのDiv
-func customBigIntDiv(a *big.Int, b *big.Int) int64 {
-	alen := len(a.Bits())
-	if alen < 4 {
-		return big.NewInt(0).Div(a, b).Int64()
-	}
-	an := big.NewInt(0).SetBits(a.Bits()[alen-3:])
-	bn := big.NewInt(0).SetBits(b.Bits()[alen-3:])
-	return big.NewInt(0).Div(an, bn).Int64()
+// getForecast に対して GameResponse の前に返す、各アイテムが買えるようになる時刻。
+// Forecast は接続の Encoding で書いた game.Forecast
+type ForecastMessage struct {
+	Forecast json.RawMessage `json:"forecast"`
 }
 
-// int64をそのまま文字列化すると15桁以上になりうるので調整が必要
-func int64ToExponential(significand, exponent int64) Exponential {
-	var addketa int64
-	var divten int64
-	if significand < 1000000000000000 {
-		addketa, divten = 0, 1
-	} else if significand < 10000000000000000 {
-		addketa, divten = 1, 10
-	} else if significand < 100000000000000000 {
-		addketa, divten = 2, 100
-	} else if significand < 1000000000000000000 {
-		addketa, divten = 3, 1000
-	} else {
-		addketa, divten = 4, 10000
-	}
-	return Exponential{significand / divten, exponent + addketa}
+// 接続ごとの設定
+type connOptions struct {
+	encoding game.Encoding // GameStatus などの Exponential の表現
 }
 
-func setupTenCache() []big.Int {
-	var tenCache = make([]big.Int, 50000) // メモリに応じて適宜調整のこと
-	bigTen := big.NewInt(10)
-	tenCache[0].Exp(bigTen, big.NewInt(int64(0)), nil)
-	for i := 1; i < len(tenCache); i++ {
-		tenCache[i].Mul(bigTen, &tenCache[i-1])
-	}
-	return tenCache
+// buyItems で、アイテム ItemID を CountBought+1 個目から Count 個買う
+type BuyOrder struct {
+	ItemID      int `json:"item_id"`
+	CountBought int `json:"count_bought"`
+	Count       int `json:"count"`
 }
 
-var tenCache = setupTenCache()
-var ten = big.NewInt(10)
-
-func big2exp(n *big.Int) Exponential {
-	w := n.Bits()
-	if len(w) <= 1 {
-		return int64ToExponential(n.Int64(), 0)
-	}
-	w1 := float64(w[len(w)-1]) // 上のケタ
-	w2 := float64(w[len(w)-2]) // 下のケタ
-	bef := len(w) - 2
-	log10ed := math.Log10(2) * 64 * float64(bef)
-	log10ed += math.Log10(float64(1<<64)*w1 + w1 + w2)
-	keta := int64(log10ed - 14.0)
-	if keta < int64(len(tenCache)) {
-		ketaInt := &tenCache[keta]
-		significand := customBigIntDiv(n, ketaInt)
-		return int64ToExponential(significand, keta)
-	} else {
-		ketaInt := big.NewInt(0).Exp(ten, big.NewInt(keta), nil)
-		significand := customBigIntDiv(n, ketaInt)
-		return int64ToExponential(significand, keta)
-	}
+type GameResponse struct {
+	RequestID int  `json:"request_id"`
+	IsSuccess bool `json:"is_success"`
+	Bought    int  `json:"bought,omitempty"` // buyItems で買えた個数
 }
 
 func getCurrentTime() int64 {
 	return time.Now().UnixNano() / 1000000
 }
 
-// 部屋のロックを取りタイムスタンプを更新する
-//
-// トランザクション開始後この関数を呼ぶ前にクエリを投げると、
-// そのトランザクション中の通常のSELECTクエリが返す結果がロック取得前の
-// 状態になることに注意 (keyword: MVCC, repeatable read).
-func updateRoomTime(tx *sqlx.Tx, roomName string, reqTime int64) (int64, bool) {
-	// See page 13 and 17 in https://www.slideshare.net/ichirin2501/insert-51938787
-	var roomTime int64
-	roomTime, err := client.GetBit(roomName, 0).Result()
-	if err == redis.Nil {
-		roomTime = 0
-	} else if err != nil {
-		return 0, false
-	}
+var (
+	errReqTimePast = errors.New("reqTime is past")
+	errNotEnough   = errors.New("not enough")
+	errInvalidItem = errors.New("invalid item")
+
+	errInvalidHorizon = errors.New("invalid horizon")
+	errInvalidCount   = errors.New("invalid count")
+
+	errNotBuilt = errors.New("not built")
+)
 
+// 部屋の時刻を現在時刻に進める
+func updateRoomTime(roomName string, reqTime int64) (int64, error) {
 	currentTime := getCurrentTime()
-	if roomTime > currentTime {
-		log.Println("room time is future")
-		return 0, false
-	}
 	if reqTime != 0 {
 		if reqTime < currentTime {
-			log.Println("reqTime is past")
-			return 0, false
+			return 0, errReqTimePast
 		}
 	}
 
-	err = client.Set(roomName, currentTime, 0).Err()
+	err := roomClock.Advance(roomName, currentTime)
 	if err != nil {
-		return 0, false
+		return 0, err
 	}
 
-	return currentTime, true
+	return currentTime, nil
 }
 
-type IsuReq struct {
-	roomName string
-	reqTime  int64
-	ch       chan bool
+// 拒否は想定内なので debug、それ以外の失敗は error で出す
+func logAction(ctx context.Context, err error, args ...interface{}) {
+	if err == nil {
+		return
+	}
+	if actionRejectReason(err) == reasonError {
+		logger.ErrorContext(ctx, "action failed", append(args, "err", err)...)
+		return
+	}
+	logger.DebugContext(ctx, "action rejected", append(args, "reason", err.Error())...)
 }
 
-var addReqCh = make(chan IsuReq, 0)
-var testReqCh = make(chan IsuReq, 0)
-var initCh = make(chan struct{}, 0)
-
-func isuFilterHandler() {
-	filters := make(map[string]map[int64]struct{})
-	for {
-		select {
-		case addReq := <-addReqCh:
-			if _, ok := filters[addReq.roomName]; !ok {
-				filters[addReq.roomName] = make(map[int64]struct{})
-			}
-			filters[addReq.roomName][addReq.reqTime] = struct{}{}
-		case testReq := <-testReqCh:
-			if _, ok := filters[testReq.roomName]; !ok {
-				filters[testReq.roomName] = make(map[int64]struct{})
-			}
-			_, ok := filters[testReq.roomName][testReq.reqTime]
-			testReq.ch <- ok
-		case <-initCh:
-			filters = make(map[string]map[int64]struct{})
-		}
-	}
+func addIsu(ctx context.Context, roomName string, reqIsu *big.Int, reqTime int64) bool {
+	err := tryAddIsu(roomName, reqIsu, reqTime)
+	logAction(ctx, err, "isu", reqIsu.String(), "time", reqTime)
+	return observeAction("addIsu", err)
 }
 
-func addIsu(roomName string, reqIsu *big.Int, reqTime int64) bool {
-	tx, err := db.Beginx()
+func tryAddIsu(roomName string, reqIsu *big.Int, reqTime int64) error {
+	currentTime, err := updateRoomTime(roomName, reqTime)
 	if err != nil {
-		log.Println(err)
-		return false
+		return err
 	}
 
-	_, ok := updateRoomTime(tx, roomName, reqTime)
-	if !ok {
-		tx.Rollback()
-		return false
+	r, err := lockRoomState(roomName, currentTime)
+	if err != nil {
+		return err
 	}
+	defer r.mu.Unlock()
 
-	ch := make(chan bool)
-	testReqCh <- IsuReq{roomName, reqTime, ch}
-	exist := <-ch
-	if exist {
-		isu := big.NewInt(0)
-		var isuStr string
-		err = tx.QueryRow("SELECT isu FROM adding WHERE room_name = ? AND time = ? FOR UPDATE", roomName, reqTime).Scan(&isuStr)
-		if err != nil {
-			log.Println(err)
-			tx.Rollback()
-			return false
-		}
-		isu = str2big(isuStr)
-
-		isu.Add(isu, reqIsu)
-		_, err = tx.Exec("UPDATE adding SET isu = ? WHERE room_name = ? AND time = ?", isu.String(), roomName, reqTime)
-		if err != nil {
-			log.Println(err)
-			tx.Rollback()
-			return false
-		}
-	} else {
-		_, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE isu=isu", roomName, reqTime, reqIsu.String())
-		if err != nil {
-			log.Println(err)
-			tx.Rollback()
-			return false
-		}
-		addReqCh <- IsuReq{roomName, reqTime, nil}
+	r.state.AddIsu(reqTime, reqIsu)
+	r.state.started = true
+	err = r.record(roomName, RoomEvent{
+		Type:      eventIsuAdded,
+		Time:      reqTime,
+		Isu:       reqIsu.String(),
+		CreatedAt: currentTime,
+	})
+	if err != nil {
+		return err
 	}
+	mirrorToStore(roomName, store.AddIsu(roomName, reqTime, reqIsu))
+	return nil
+}
 
-	if err := tx.Commit(); err != nil {
-		log.Println(err)
-		return false
-	}
-	return true
+func buyItem(ctx context.Context, roomName string, itemID int, countBought int, reqTime int64) bool {
+	err := tryBuyItem(roomName, itemID, countBought, reqTime)
+	logAction(ctx, err, "item_id", itemID, "ordinal", countBought+1, "time", reqTime)
+	return observeAction("buyItem", err)
 }
 
-func buyItem(roomName string, itemID int, countBought int, reqTime int64) bool {
-	tx, err := db.Beginx()
+func tryBuyItem(roomName string, itemID int, countBought int, reqTime int64) error {
+	currentTime, err := updateRoomTime(roomName, reqTime)
 	if err != nil {
-		log.Println(err)
-		return false
-	}
-
-	_, ok := updateRoomTime(tx, roomName, reqTime)
-	if !ok {
-		tx.Rollback()
-		return false
+		return err
 	}
 
-	var countBuying int
-	err = tx.Get(&countBuying, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ?", roomName, itemID)
+	r, err := lockRoomState(roomName, currentTime)
 	if err != nil {
-		log.Println(err)
-		tx.Rollback()
-		return false
+		return err
 	}
-	if countBuying != countBought {
-		tx.Rollback()
-		log.Println(roomName, itemID, countBought+1, " is already bought")
-		return false
+	defer r.mu.Unlock()
+
+	if r.state.CountBought(itemID) != countBought {
+		return errAlreadyBought
 	}
 
-	totalMilliIsu := new(big.Int)
-	var addings []Adding
-	err = tx.Select(&addings, "SELECT isu FROM adding WHERE room_name = ? AND time <= ?", roomName, reqTime)
+	item, ok := r.state.Items()[itemID]
+	if !ok {
+		return errInvalidItem
+	}
+	need := new(big.Int).Mul(item.GetPrice(countBought+1), big1000)
+	if r.state.MilliIsuAt(reqTime).Cmp(need) < 0 {
+		return errNotEnough
+	}
+
+	b := game.Buying{
+		RoomName: roomName,
+		ItemID:   itemID,
+		Ordinal:  countBought + 1,
+		Time:     reqTime,
+	}
+	r.state.Buy(b)
+	r.state.started = true
+	err = r.record(roomName, RoomEvent{
+		Type:      eventItemBought,
+		Time:      reqTime,
+		ItemID:    itemID,
+		Ordinal:   b.Ordinal,
+		CreatedAt: currentTime,
+	})
 	if err != nil {
-		log.Println(err)
-		tx.Rollback()
-		return false
+		return err
 	}
+	mirrorToStore(roomName, store.InsertBuying(roomName, b))
+
+	return nil
+}
 
-	for _, a := range addings {
-		totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(str2big(a.Isu), big1000))
+func buyItems(ctx context.Context, roomName string, orders []BuyOrder, bestEffort bool, reqTime int64) (int, bool) {
+	bought, err := tryBuyItems(roomName, orders, bestEffort, reqTime)
+	logAction(ctx, err, "orders", len(orders), "best_effort", bestEffort, "bought", bought, "time", reqTime)
+	return bought, observeAction("buyItems", err)
+}
+
+// orders の順に時刻 reqTime に買う。買えた個数を返す。
+// bestEffort なら買えなくなったところで止め、1 個も買えなかったときだけエラーを返す
+func tryBuyItems(roomName string, orders []BuyOrder, bestEffort bool, reqTime int64) (int, error) {
+	// 足す前に上限と比べるので、大きな Count でも total は溢れない
+	total := 0
+	for _, o := range orders {
+		if o.Count <= 0 || maxBuyItems < o.Count {
+			return 0, errInvalidCount
+		}
+		total += o.Count
+		if maxBuyItems < total {
+			return 0, errInvalidCount
+		}
+	}
+	if total == 0 {
+		return 0, errInvalidCount
 	}
 
-	var buyings []Buying
-	err = tx.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
+	currentTime, err := updateRoomTime(roomName, reqTime)
 	if err != nil {
-		log.Println(err)
-		tx.Rollback()
-		return false
+		return 0, err
 	}
-	for _, b := range buyings {
-		item := itemLists[b.ItemID]
-		cost := new(big.Int).Mul(item.GetPrice(b.Ordinal), big1000)
-		totalMilliIsu.Sub(totalMilliIsu, cost)
-		if b.Time <= reqTime {
-			gain := new(big.Int).Mul(item.GetPower(b.Ordinal), big.NewInt(reqTime-b.Time))
-			totalMilliIsu.Add(totalMilliIsu, gain)
+
+	r, err := lockRoomState(roomName, currentTime)
+	if err != nil {
+		return 0, err
+	}
+	defer r.mu.Unlock()
+
+	// 全て時刻 reqTime に買うので、買ったアイテムの生産力はこの中では使えない
+	milliIsu := r.state.MilliIsuAt(reqTime)
+	counts := map[int]int{}
+	buyings := []game.Buying{}
+	var rejected error
+orders:
+	for _, o := range orders {
+		item, ok := r.state.Items()[o.ItemID]
+		if !ok {
+			rejected = errInvalidItem
+			break
+		}
+		count, ok := counts[o.ItemID]
+		if !ok {
+			count = r.state.CountBought(o.ItemID)
 		}
+		if count != o.CountBought {
+			rejected = errAlreadyBought
+			break
+		}
+		for i := 0; i < o.Count; i++ {
+			milliIsu.Sub(milliIsu, new(big.Int).Mul(item.GetPrice(count+1), big1000))
+			if milliIsu.Sign() < 0 {
+				rejected = errNotEnough
+				break orders
+			}
+			count++
+			buyings = append(buyings, game.Buying{
+				RoomName: roomName,
+				ItemID:   o.ItemID,
+				Ordinal:  count,
+				Time:     reqTime,
+			})
+		}
+		counts[o.ItemID] = count
 	}
-	item := itemLists[itemID]
-	need := new(big.Int).Mul(item.GetPrice(countBought+1), big1000)
-	if totalMilliIsu.Cmp(need) < 0 {
-		log.Println("not enough")
-		tx.Rollback()
-		return false
+	if rejected != nil && (!bestEffort || len(buyings) == 0) {
+		return 0, rejected
 	}
 
-	_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", roomName, itemID, countBought+1, reqTime)
-	if err != nil {
-		log.Println(err)
-		tx.Rollback()
-		return false
+	events := make([]RoomEvent, 0, len(buyings))
+	for _, b := range buyings {
+		r.state.Buy(b)
+		events = append(events, RoomEvent{
+			Type:      eventItemBought,
+			Time:      reqTime,
+			ItemID:    b.ItemID,
+			Ordinal:   b.Ordinal,
+			CreatedAt: currentTime,
+		})
 	}
-
-	if err := tx.Commit(); err != nil {
-		log.Println(err)
-		return false
+	r.state.started = true
+	err = r.record(roomName, events...)
+	if err != nil {
+		return 0, err
 	}
+	mirrorToStore(roomName, store.InsertBuyings(roomName, buyings))
+	return len(buyings), nil
+}
 
-	return true
+func sellItem(ctx context.Context, roomName string, itemID int, countBought int, reqTime int64) bool {
+	err := trySellItem(roomName, itemID, countBought, reqTime)
+	logAction(ctx, err, "item_id", itemID, "ordinal", countBought, "time", reqTime)
+	return observeAction("sellItem", err)
 }
 
-func getStatusWithGroup(roomName string) (*GameStatus, error) {
-	v, err, shared := group.Do(roomName, func() (interface{}, error) {
-		return getStatus(roomName)
-	})
+// countBought 個目を時刻 reqTime に売り、価格の config.SellRefund パーセントを返金する。
+// reqTime までに効果を発揮していないものは売れない
+func trySellItem(roomName string, itemID int, countBought int, reqTime int64) error {
+	currentTime, err := updateRoomTime(roomName, reqTime)
 	if err != nil {
-		return nil, err
-	}
-	status, ok := v.(*GameStatus)
-	if !ok {
-		return nil, fmt.Errorf("Failed to assert v")
+		return err
 	}
-	log.Println("getStatusWithGroup::room:", roomName)
-	log.Println("getStatusWithGroup::shared:", shared)
-	return status, nil
-}
 
-func getStatus(roomName string) (*GameStatus, error) {
-	tx, err := db.Beginx()
+	r, err := lockRoomState(roomName, currentTime)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer r.mu.Unlock()
 
-	currentTime, ok := updateRoomTime(tx, roomName, 0)
-	if !ok {
-		tx.Rollback()
-		return nil, fmt.Errorf("updateRoomTime failure")
+	if r.state.CountBought(itemID) != countBought {
+		return errAlreadyBought
 	}
 
-	addings := []Adding{}
-	err = tx.Select(&addings, "SELECT time, isu FROM adding WHERE room_name = ?", roomName)
+	item, ok := r.state.Items()[itemID]
+	if !ok {
+		return errInvalidItem
+	}
+	if countBought <= 0 {
+		return errInvalidCount
+	}
+	if reqTime < r.state.BuildTime(itemID, countBought) {
+		return errNotBuilt
+	}
+
+	refund := new(big.Int).Mul(item.GetPrice(countBought), big.NewInt(int64(currentConfig().SellRefund)))
+	refund.Quo(refund, big.NewInt(100))
+	sl := game.Selling{
+		RoomName: roomName,
+		ItemID:   itemID,
+		Ordinal:  countBought,
+		Time:     reqTime,
+		Refund:   refund.String(),
+	}
+	r.state.Sell(sl)
+	r.state.started = true
+	err = r.record(roomName, RoomEvent{
+		Type:      eventItemSold,
+		Time:      reqTime,
+		Isu:       sl.Refund,
+		ItemID:    itemID,
+		Ordinal:   sl.Ordinal,
+		CreatedAt: currentTime,
+	})
 	if err != nil {
-		tx.Rollback()
-		return nil, err
+		return err
 	}
+	mirrorToStore(roomName, store.InsertSelling(roomName, sl))
 
-	buyings := []Buying{}
-	err = tx.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
+	return nil
+}
+
+func setHorizon(ctx context.Context, roomName string, horizon int64) bool {
+	err := trySetHorizon(roomName, horizon)
+	logAction(ctx, err, "horizon", horizon)
+	return observeAction("setHorizon", err)
+}
+
+// 部屋の先読み時間を変える。0 ならサーバーの既定値に戻す
+func trySetHorizon(roomName string, horizon int64) error {
+	if horizon < 0 || time.Duration(currentConfig().MaxStatusHorizon).Milliseconds() < horizon {
+		return errInvalidHorizon
 	}
 
-	err = tx.Commit()
+	currentTime, err := updateRoomTime(roomName, 0)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	status, err := calcStatus(currentTime, addings, buyings)
+	r, err := lockRoomState(roomName, currentTime)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer r.mu.Unlock()
 
-	// calcStatusに時間がかかる可能性があるので タイムスタンプを取得し直す
-	status.Time = getCurrentTime()
-	return status, err
+	// 追記できなければ record が部屋を捨てるので、元に戻さなくてよい
+	r.state.horizon = horizon
+	return r.record(roomName, RoomEvent{
+		Type:      eventHorizonSet,
+		Time:      currentTime,
+		Horizon:   horizon,
+		CreatedAt: currentTime,
+	})
 }
 
-func calcStatus(currentTime int64, addings []Adding, buyings []Buying) (*GameStatus, error) {
-	var (
-		// 1ミリ秒に生産できる椅子の単位をミリ椅子とする
-		totalMilliIsu = big.NewInt(0)
-		totalPower    = big.NewInt(0)
-
-		itemPower      = make([]*big.Int, len(itemLists))    // ItemID => Power
-		itemPrice      = make([]*big.Int, len(itemLists))    // ItemID => Price
-		itemPricex1000 = make([]*big.Int, len(itemLists))    // itemPricex1000
-		itemOnSale     = map[int]int64{}                     // ItemID => OnSale
-		itemBuilt      = make([]int, len(itemLists))         // ItemID => BuiltCount
-		itemBought     = make([]int, len(itemLists))         // ItemID => CountBought
-		itemBuilding   = make([][]Building, len(itemLists))  // ItemID => Buildings
-		itemPower0     = make([]Exponential, len(itemLists)) // ItemID => currentTime における Power
-		itemBuilt0     = make([]int, len(itemLists))         // ItemID => currentTime における BuiltCount
-
-		addingAt = map[int64]Adding{}   // Time => currentTime より先の Adding
-		buyingAt = map[int64][]Buying{} // Time => currentTime より先の Buying
-	)
-
-	for itemID := range itemLists {
-		if itemID == 0 {
-			continue
-		}
-		itemPower[itemID] = big.NewInt(0)
-		itemBuilding[itemID] = []Building{}
-	}
-
-	for _, a := range addings {
-		// adding は adding.time に isu を増加させる
-		if a.Time <= currentTime {
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(str2big(a.Isu), big1000))
-		} else {
-			addingAt[a.Time] = a
-		}
+// 部屋で使っているアイテムの一覧。部屋のアイテムは読み直す前のものかもしれない
+func roomCatalog(roomName string, ordinals int) (game.Catalog, error) {
+	ordinals, err := catalogOrdinals(ordinals)
+	if err != nil {
+		return game.Catalog{}, err
 	}
 
-	for _, b := range buyings {
-		// buying は 即座に isu を消費し buying.time からアイテムの効果を発揮する
-		itemBought[b.ItemID]++
-		m := itemLists[b.ItemID]
-		totalMilliIsu.Sub(totalMilliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), big1000))
-
-		if b.Time <= currentTime {
-			itemBuilt[b.ItemID]++
-			power := m.GetPower(itemBought[b.ItemID])
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(power, big.NewInt(currentTime-b.Time)))
-			totalPower.Add(totalPower, power)
-			itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
-		} else {
-			buyingAt[b.Time] = append(buyingAt[b.Time], b)
-		}
+	// 読むだけなので部屋の時計は進めない。まだ何も無い部屋は今のアイテムを使う
+	r, err := lockRoomStateForRead(roomName)
+	if err == errRoomNotFound {
+		return game.NewCatalog(currentItems(), ordinals), nil
 	}
-
-	for i, m := range itemLists {
-		if i == 0 {
-			continue
-		}
-		itemPower0[m.ItemID] = big2exp(itemPower[m.ItemID])
-		itemBuilt0[m.ItemID] = itemBuilt[m.ItemID]
-		price := m.GetPrice(itemBought[m.ItemID] + 1)
-		itemPrice[m.ItemID] = price
-		itemPricex1000[m.ItemID] = new(big.Int).Mul(price, big1000)
-		if 0 <= totalMilliIsu.Cmp(itemPricex1000[m.ItemID]) {
-			itemOnSale[m.ItemID] = 0 // 0 は 時刻 currentTime で購入可能であることを表す
-		}
+	if err != nil {
+		return game.Catalog{}, err
 	}
+	mItems := r.state.Items()
+	r.mu.Unlock()
+	return game.NewCatalog(mItems, ordinals), nil
+}
 
-	schedule := []Schedule{
-		Schedule{
-			Time:       currentTime,
-			MilliIsu:   big2exp(totalMilliIsu),
-			TotalPower: big2exp(totalPower),
-		},
+func getStatusWithGroup(ctx context.Context, roomName string) (*game.Status, error) {
+	v, err, shared := group.Do(roomName, func() (interface{}, error) {
+		return getStatus(roomName, 0)
+	})
+	statusGroupTotal.Inc(strconv.FormatBool(shared))
+	if err != nil {
+		return nil, err
 	}
-
-	// currentTime から 1000 ミリ秒先までシミュレーションする
-
-	for t := currentTime + 1; t <= currentTime+1000; t++ {
-		totalMilliIsu.Add(totalMilliIsu, totalPower) //
-		updated := false
-
-		// 時刻 t で発生する adding を計算する
-		if a, ok := addingAt[t]; ok {
-			updated = true
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(str2big(a.Isu), big1000)) //
-		}
-
-		// 時刻 t で発生する buying を計算する
-		if _, ok := buyingAt[t]; ok {
-			updated = true
-			// updatedID := map[int]bool{}
-			for _, b := range buyingAt[t] {
-				m := itemLists[b.ItemID]
-				// updatedID[b.ItemID] = true
-				itemBuilt[b.ItemID]++
-				power := m.GetPower(b.Ordinal)
-				itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
-				totalPower.Add(totalPower, power)
-
-				// bad
-				id := b.ItemID
-				itemBuilding[id] = append(itemBuilding[id], Building{
-					Time:       t,
-					CountBuilt: itemBuilt[id],
-					Power:      big2exp(itemPower[id]),
-				})
-			}
-			// for id := range updatedID {
-			// 	itemBuilding[id] = append(itemBuilding[id], Building{
-			// 		Time:       t,
-			// 		CountBuilt: itemBuilt[id],
-			// 		Power:      big2exp(itemPower[id]),
-			// 	})
-			// }
-		}
-
-		if updated {
-			schedule = append(schedule, Schedule{
-				Time:       t,
-				MilliIsu:   big2exp(totalMilliIsu),
-				TotalPower: big2exp(totalPower),
-			})
-		}
-
-		// 時刻 t で購入可能になったアイテムを記録する
-		for itemID := range itemLists {
-			if itemID == 0 {
-				continue
-			}
-			if _, ok := itemOnSale[itemID]; ok {
-				continue
-			}
-			if 0 <= totalMilliIsu.Cmp(itemPricex1000[itemID]) { //
-				itemOnSale[itemID] = t
-			}
-		}
+	status, ok := v.(*game.Status)
+	if !ok {
+		return nil, fmt.Errorf("Failed to assert v")
 	}
+	logger.DebugContext(ctx, "getStatusWithGroup", "shared", shared)
+	return status, nil
+}
 
-	gsAdding := []Adding{}
-	for _, a := range addingAt {
-		gsAdding = append(gsAdding, a)
-	}
+// horizon ミリ秒先までの GameStatus を返す。0 なら部屋の設定に従う
+func getStatus(roomName string, horizon int64) (*game.Status, error) {
+	defer getStatusSeconds.ObserveSince(time.Now())
 
-	gsItems := []Item{}
-	for itemID, _ := range itemLists {
-		if itemID == 0 {
-			continue
-		}
-		gsItems = append(gsItems, Item{
-			ItemID:      itemID,
-			CountBought: itemBought[itemID],
-			CountBuilt:  itemBuilt0[itemID],
-			NextPrice:   big2exp(itemPrice[itemID]),
-			Power:       itemPower0[itemID],
-			Building:    itemBuilding[itemID],
-		})
+	currentTime, err := updateRoomTime(roomName, 0)
+	if err != nil {
+		return nil, err
 	}
 
-	gsOnSale := []OnSale{}
-	for itemID, t := range itemOnSale {
-		gsOnSale = append(gsOnSale, OnSale{
-			ItemID: itemID,
-			Time:   t,
-		})
+	r, err := lockRoomState(roomName, currentTime)
+	if err != nil {
+		return nil, err
 	}
+	start := time.Now()
+	status := r.state.Status(r.state.statusHorizon(horizon))
+	calcStatusSeconds.ObserveSince(start)
+	r.mu.Unlock()
 
-	return &GameStatus{
-		Adding:   gsAdding,
-		Schedule: schedule,
-		Items:    gsItems,
-		OnSale:   gsOnSale,
-	}, nil
+	// calcStatusに時間がかかる可能性があるので タイムスタンプを取得し直す
+	status.Time = getCurrentTime()
+	return status, nil
 }
 
 func roomHandler(roomName string, room Room) {
@@ -621,7 +473,11 @@ func roomHandler(roomName string, room Room) {
 		room.wg.Wait()
 		close(closeCh)
 	}()
-	ticker := time.NewTicker(duration)
+	atomic.AddInt64(&roomWorkers, 1)
+	defer atomic.AddInt64(&roomWorkers, -1)
+
+	ticker := time.NewTicker(time.Duration(currentConfig().RoomTick))
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
@@ -634,10 +490,22 @@ func roomHandler(roomName string, room Room) {
 	}
 }
 
-func serveGameConn(ws *websocket.Conn, roomName string) {
-	log.Println(ws.RemoteAddr(), "serveGameConn", roomName)
+func serveGameConn(ws *websocket.Conn, roomName string, opts *connOptions) {
+	ctx, cancel := context.WithCancel(withLogAttrs(context.Background(),
+		"room", roomName, "remote_addr", ws.RemoteAddr().String()))
+	defer cancel()
+
+	logger.InfoContext(ctx, "serveGameConn")
 	defer ws.Close()
 
+	if !registerConn(ws) {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownCloseReason),
+			time.Now().Add(time.Second))
+		return
+	}
+	defer unregisterConn(ws)
+
 	v, loaded := rooms.LoadOrStore(roomName, Room{new(sync.WaitGroup), sync.NewCond(new(sync.Mutex))})
 	room := v.(Room)
 	room.wg.Add(1)
@@ -646,21 +514,10 @@ func serveGameConn(ws *websocket.Conn, roomName string) {
 		go roomHandler(roomName, room)
 	}
 
-	status, err := getStatusWithGroup(roomName)
-	if err != nil {
-		log.Println(err)
+	if !writeStatus(ctx, ws, opts, roomName) {
 		return
 	}
 
-	err = ws.WriteJSON(status)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	chReq := make(chan GameRequest)
 
 	go func() {
@@ -669,7 +526,7 @@ func serveGameConn(ws *websocket.Conn, roomName string) {
 			req := GameRequest{}
 			err := ws.ReadJSON(&req)
 			if err != nil {
-				log.Println(err)
+				logger.DebugContext(ctx, "stopped reading requests", "err", err)
 				return
 			}
 
@@ -681,61 +538,26 @@ func serveGameConn(ws *websocket.Conn, roomName string) {
 		}
 	}()
 
-	ticker := time.NewTicker(500 * time.Millisecond)
+	ticker := time.NewTicker(time.Duration(currentConfig().PushInterval))
 	defer ticker.Stop()
 
 	for {
 		select {
 		case req := <-chReq:
-			log.Println(req)
-
-			success := false
-			switch req.Action {
-			case "addIsu":
-				success = addIsu(roomName, str2big(req.Isu), req.Time)
-			case "buyItem":
-				success = buyItem(roomName, req.ItemID, req.CountBought, req.Time)
-			default:
-				log.Println("Invalid Action")
-				return
-			}
-
-			if success {
-				// GameResponse を返却する前に 反映済みの GameStatus を返す
-				room.c.L.Lock()
-				room.c.Wait()
-				room.c.L.Unlock()
-				status, err := getStatusWithGroup(roomName)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				err = ws.WriteJSON(status)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-			}
+			reqCtx := withLogAttrs(ctx, "request_id", req.RequestID, "action", req.Action)
+			logger.DebugContext(reqCtx, "game request")
 
-			err := ws.WriteJSON(GameResponse{
-				RequestID: req.RequestID,
-				IsSuccess: success,
-			})
-			if err != nil {
-				log.Println(err)
+			// シャットダウン中は新しい操作を受け付けない
+			if !beginAction() {
 				return
 			}
-		case <-ticker.C:
-			status, err := getStatusWithGroup(roomName)
-			if err != nil {
-				log.Println(err)
+			ok := serveGameRequest(reqCtx, ws, opts, room, roomName, req)
+			endAction()
+			if !ok {
 				return
 			}
-
-			err = ws.WriteJSON(status)
-			if err != nil {
-				log.Println(err)
+		case <-ticker.C:
+			if !writeStatus(ctx, ws, opts, roomName) {
 				return
 			}
 		case <-ctx.Done():
@@ -743,3 +565,135 @@ func serveGameConn(ws *websocket.Conn, roomName string) {
 		}
 	}
 }
+
+// 最新の GameStatus を送る。接続を閉じるべきときは false を返す
+func writeStatus(ctx context.Context, ws *websocket.Conn, opts *connOptions, roomName string) bool {
+	status, err := getStatusWithGroup(ctx, roomName)
+	return writeStatusResult(ctx, ws, opts, status, err)
+}
+
+// 先読み時間を指定した GameStatus を送る。他の接続とは共有しない
+func writeStatusWithin(ctx context.Context, ws *websocket.Conn, opts *connOptions, roomName string, horizon int64) bool {
+	if horizon == 0 {
+		return writeStatus(ctx, ws, opts, roomName)
+	}
+	status, err := getStatus(roomName, horizon)
+	return writeStatusResult(ctx, ws, opts, status, err)
+}
+
+func writeStatusResult(ctx context.Context, ws *websocket.Conn, opts *connOptions, status *game.Status, err error) bool {
+	if err != nil {
+		logger.ErrorContext(ctx, "failed to get status", "err", err)
+		return false
+	}
+
+	b, err := status.Encode(opts.encoding)
+	if err == nil {
+		err = ws.WriteMessage(websocket.TextMessage, b)
+	}
+	if err != nil {
+		logger.WarnContext(ctx, "failed to write status", "err", err)
+		return false
+	}
+	return true
+}
+
+// 操作を1つ処理して結果を返す。接続を閉じるべきときは false を返す
+func serveGameRequest(ctx context.Context, ws *websocket.Conn, opts *connOptions, room Room, roomName string, req GameRequest) bool {
+	success := false
+	bought := 0
+	switch req.Action {
+	case "addIsu":
+		success = addIsu(ctx, roomName, game.Str2Big(req.Isu), req.Time)
+	case "buyItem":
+		success = buyItem(ctx, roomName, req.ItemID, req.CountBought, req.Time)
+	case "buyItems":
+		orders := req.Items
+		if len(orders) == 0 {
+			orders = []BuyOrder{{ItemID: req.ItemID, CountBought: req.CountBought, Count: req.Count}}
+		}
+		bought, success = buyItems(ctx, roomName, orders, req.BestEffort, req.Time)
+	case "sellItem":
+		success = sellItem(ctx, roomName, req.ItemID, req.CountBought, req.Time)
+	case "setHorizon":
+		success = setHorizon(ctx, roomName, req.Horizon)
+	case "getItems":
+		catalog, err := roomCatalog(roomName, req.Ordinals)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to get items", "err", err)
+			return writeResponse(ctx, ws, req.RequestID, false)
+		}
+		b, err := catalog.Encode(opts.encoding)
+		if err == nil {
+			err = ws.WriteJSON(CatalogMessage{Catalog: b})
+		}
+		if err != nil {
+			logger.WarnContext(ctx, "failed to write items", "err", err)
+			return false
+		}
+		return writeResponse(ctx, ws, req.RequestID, true)
+	case "getForecast":
+		forecast, err := roomForecast(roomName, req.Ordinals)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to forecast", "err", err)
+			return writeResponse(ctx, ws, req.RequestID, false)
+		}
+		b, err := forecast.Encode(opts.encoding)
+		if err == nil {
+			err = ws.WriteJSON(ForecastMessage{Forecast: b})
+		}
+		if err != nil {
+			logger.WarnContext(ctx, "failed to write forecast", "err", err)
+			return false
+		}
+		return writeResponse(ctx, ws, req.RequestID, true)
+	case "getStatus":
+		if req.Horizon < 0 {
+			return writeResponse(ctx, ws, req.RequestID, false)
+		}
+		return writeStatusWithin(ctx, ws, opts, roomName, req.Horizon) &&
+			writeResponse(ctx, ws, req.RequestID, true)
+	case "setEncoding":
+		enc, err := game.ParseEncoding(req.Encoding)
+		if err != nil {
+			return writeResponse(ctx, ws, req.RequestID, false)
+		}
+		opts.encoding = enc
+		return writeResponse(ctx, ws, req.RequestID, true)
+	default:
+		logger.WarnContext(ctx, "invalid action")
+		return false
+	}
+
+	if success {
+		// GameResponse を返却する前に 反映済みの GameStatus を返す
+		room.c.L.Lock()
+		room.c.Wait()
+		room.c.L.Unlock()
+		if !writeStatus(ctx, ws, opts, roomName) {
+			return false
+		}
+	}
+
+	return writeGameResponse(ctx, ws, GameResponse{
+		RequestID: req.RequestID,
+		IsSuccess: success,
+		Bought:    bought,
+	})
+}
+
+func writeResponse(ctx context.Context, ws *websocket.Conn, requestID int, success bool) bool {
+	return writeGameResponse(ctx, ws, GameResponse{
+		RequestID: requestID,
+		IsSuccess: success,
+	})
+}
+
+func writeGameResponse(ctx context.Context, ws *websocket.Conn, res GameResponse) bool {
+	err := ws.WriteJSON(res)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to write response", "err", err)
+		return false
+	}
+	return true
+}
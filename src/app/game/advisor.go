@@ -0,0 +1,209 @@
+package game
+
+import (
+	"encoding/json"
+	"math/big"
+	"sort"
+)
+
+// 計画で買う最大の個数
+const MaxPlanPurchases = 100
+
+// 次の 1 個を買うときの損得。Payback は増える生産力で価格を取り戻すまでのミリ秒数
+type Advice struct {
+	ItemID  int         `json:"item_id"`
+	Ordinal int         `json:"ordinal"`
+	Price   Exponential `json:"price"`
+	Power   Exponential `json:"power"`   // 増える生産力 (倍率込み)
+	Payback int64       `json:"payback"` // 生産力が増えないなら -1
+	Time    int64       `json:"time"`    // 買えるようになる時刻。買えないなら -1
+}
+
+// 計画した購入
+type Purchase struct {
+	ItemID  int         `json:"item_id"`
+	Ordinal int         `json:"ordinal"`
+	Price   Exponential `json:"price"`
+	Time    int64       `json:"time"`
+}
+
+// Time から Time + Budget までに買うものと、その結果
+type Plan struct {
+	Time       int64       `json:"time"`
+	Budget     int64       `json:"budget"`
+	Purchases  []Purchase  `json:"purchases"`
+	MilliIsu   Exponential `json:"milli_isu"`   // Time + Budget のミリ椅子
+	TotalPower Exponential `json:"total_power"` // Time + Budget の総生産力
+}
+
+type candidate struct {
+	Advice
+	price   *big.Int
+	payback *big.Int // nil なら生産力が増えない
+}
+
+// 各アイテムの次の 1 個を Payback の短い順に並べる。
+// Payback が同じなら価格の安い順、生産力が増えないものは最後
+func (s *State) Rank() []Advice {
+	cs := s.candidates()
+	advice := make([]Advice, len(cs))
+	for i, c := range cs {
+		advice[i] = c.Advice
+	}
+	return advice
+}
+
+func (s *State) candidates() []candidate {
+	forecast := s.Forecast(1)
+	cs := make([]candidate, 0, len(forecast.Items))
+	for _, a := range forecast.Items {
+		m := s.mItems[a.ItemID]
+		price := m.GetPrice(a.Ordinal)
+		power := new(big.Int).Mul(m.GetPower(a.Ordinal), s.speed)
+		c := candidate{
+			Advice: Advice{
+				ItemID:  a.ItemID,
+				Ordinal: a.Ordinal,
+				Price:   a.Price,
+				Power:   Big2Exp(power),
+				Payback: -1,
+				Time:    a.Time,
+			},
+			price: price,
+		}
+		if 0 < power.Sign() {
+			// milliIsu は毎ミリ秒 power 増えるので、price * 1000 / power ミリ秒で取り戻せる
+			c.payback = ceilQuo(new(big.Int).Mul(price, big1000), power)
+			if c.payback.IsInt64() {
+				c.Payback = c.payback.Int64()
+			}
+		}
+		cs = append(cs, c)
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := cs[i], cs[j]
+		if (a.payback == nil) != (b.payback == nil) {
+			return b.payback == nil
+		}
+		if a.payback != nil {
+			if c := a.payback.Cmp(b.payback); c != 0 {
+				return c < 0
+			}
+		}
+		return a.price.Cmp(b.price) < 0
+	})
+	return cs
+}
+
+// budget ミリ秒の間に買うものを貪欲に決める。
+// 毎回、budget の間に買えるもののうち Payback が最も短いものを、買えるようになった時刻に買う
+func (s *State) Plan(budget int64) *Plan {
+	end := s.time + budget
+	x := s.clone()
+	plan := &Plan{Time: s.time, Budget: budget, Purchases: []Purchase{}}
+	for len(plan.Purchases) < MaxPlanPurchases {
+		var best *candidate
+		for _, c := range x.candidates() {
+			if c.payback != nil && 0 <= c.Time && c.Time <= end {
+				best = &c
+				break
+			}
+		}
+		if best == nil {
+			break
+		}
+		x.Advance(best.Time)
+		x.Buy(Buying{ItemID: best.ItemID, Ordinal: best.Ordinal, Time: best.Time})
+		plan.Purchases = append(plan.Purchases, Purchase{
+			ItemID:  best.ItemID,
+			Ordinal: best.Ordinal,
+			Price:   best.Price,
+			Time:    best.Time,
+		})
+	}
+	x.Advance(end)
+	plan.MilliIsu = Big2Exp(x.milliIsu)
+	plan.TotalPower = Big2Exp(x.power)
+	return plan
+}
+
+func (s *State) clone() *State {
+	x := *s
+	x.milliIsu = new(big.Int).Set(s.milliIsu)
+	x.power = new(big.Int).Set(s.power)
+	x.bought = make(map[int]int, len(s.bought))
+	for id, n := range s.bought {
+		x.bought[id] = n
+	}
+	x.built = make(map[int]int, len(s.built))
+	for id, n := range s.built {
+		x.built[id] = n
+	}
+	x.itemPower = make(map[int]*big.Int, len(s.itemPower))
+	for id, p := range s.itemPower {
+		x.itemPower[id] = new(big.Int).Set(p)
+	}
+	x.pending = make([]pendingEvent, len(s.pending))
+	for i, e := range s.pending {
+		if e.isu != nil {
+			e.isu = new(big.Int).Set(e.isu)
+		}
+		x.pending[i] = e
+	}
+	return &x
+}
+
+func ceilQuo(a, b *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(a, b, new(big.Int))
+	if 0 < r.Sign() {
+		q.Add(q, big.NewInt(1))
+	}
+	return q
+}
+
+// Rank と Plan を、Exponential を enc の表現にして JSON にする
+func EncodeAdvice(ranking []Advice, plan *Plan, enc Encoding) ([]byte, error) {
+	type advice struct {
+		ItemID  int        `json:"item_id"`
+		Ordinal int        `json:"ordinal"`
+		Price   encodedExp `json:"price"`
+		Power   encodedExp `json:"power"`
+		Payback int64      `json:"payback"`
+		Time    int64      `json:"time"`
+	}
+	type purchase struct {
+		ItemID  int        `json:"item_id"`
+		Ordinal int        `json:"ordinal"`
+		Price   encodedExp `json:"price"`
+		Time    int64      `json:"time"`
+	}
+	type encodedPlan struct {
+		Time       int64      `json:"time"`
+		Budget     int64      `json:"budget"`
+		Purchases  []purchase `json:"purchases"`
+		MilliIsu   encodedExp `json:"milli_isu"`
+		TotalPower encodedExp `json:"total_power"`
+	}
+	x := struct {
+		Ranking []advice     `json:"ranking"`
+		Plan    *encodedPlan `json:"plan,omitempty"`
+	}{
+		Ranking: make([]advice, len(ranking)),
+	}
+	for i, a := range ranking {
+		x.Ranking[i] = advice{a.ItemID, a.Ordinal, encodedExp{a.Price, enc}, encodedExp{a.Power, enc}, a.Payback, a.Time}
+	}
+	if plan != nil {
+		x.Plan = &encodedPlan{
+			Time:       plan.Time,
+			Budget:     plan.Budget,
+			Purchases:  make([]purchase, len(plan.Purchases)),
+			MilliIsu:   encodedExp{plan.MilliIsu, enc},
+			TotalPower: encodedExp{plan.TotalPower, enc},
+		}
+		for i, p := range plan.Purchases {
+			x.Plan.Purchases[i] = purchase{p.ItemID, p.Ordinal, encodedExp{p.Price, enc}, p.Time}
+		}
+	}
+	return json.Marshal(x)
+}
@@ -0,0 +1,62 @@
+package game
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRank(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewStateWithRules(Rules{Items: defaultItems, Speed: 2}, 0)
+	s.AddIsu(0, big.NewInt(100))
+	ranking := s.Rank()
+	assert.Len(ranking, len(defaultItems))
+
+	last := int64(0)
+	for _, a := range ranking {
+		m := defaultItems[a.ItemID]
+		power := new(big.Int).Mul(m.GetPower(1), big.NewInt(2))
+		assert.Equal(Big2Exp(power), a.Power)
+		if power.Sign() == 0 {
+			assert.Equal(int64(-1), a.Payback)
+			continue
+		}
+		// Payback ミリ秒で価格以上を取り戻せるが、1ミリ秒短いと取り戻せない
+		need := new(big.Int).Mul(m.GetPrice(1), big1000)
+		assert.True(0 <= new(big.Int).Mul(power, big.NewInt(a.Payback)).Cmp(need))
+		assert.True(new(big.Int).Mul(power, big.NewInt(a.Payback-1)).Cmp(need) < 0)
+		assert.True(last <= a.Payback)
+		last = a.Payback
+	}
+}
+
+// 計画どおりに買っていくと、毎回ちょうど足りている
+func TestPlan(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewState(defaultItems, 0)
+	s.AddIsu(0, big.NewInt(10))
+	s.AddIsu(3000, big.NewInt(500))
+	plan := s.Plan(10000)
+	assert.NotEmpty(plan.Purchases)
+
+	x := s.clone()
+	for _, p := range plan.Purchases {
+		assert.True(s.Time() <= p.Time && p.Time <= s.Time()+10000)
+		x.Advance(p.Time)
+		m := defaultItems[p.ItemID]
+		assert.Equal(x.CountBought(p.ItemID)+1, p.Ordinal)
+		assert.True(0 <= x.milliIsu.Cmp(new(big.Int).Mul(m.GetPrice(p.Ordinal), big1000)))
+		x.Buy(Buying{ItemID: p.ItemID, Ordinal: p.Ordinal, Time: p.Time})
+	}
+	x.Advance(10000)
+	assert.Equal(Big2Exp(x.milliIsu), plan.MilliIsu)
+	assert.Equal(Big2Exp(x.power), plan.TotalPower)
+
+	// 元の状態は変わらない
+	assert.Equal(0, s.CountBought(1))
+	assert.Empty(NewState(defaultItems, 0).Plan(10000).Purchases)
+}
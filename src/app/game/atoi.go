@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package game
 
 const fastSmalls = true // enable fast path for small integers
 const nSmalls = 100
@@ -32,7 +32,7 @@ func small(i int) []byte { // WARN:
 	return smallsString[i*2 : i*2+2]
 }
 
-func FormatInt(i int64) []byte {
+func formatInt(i int64) []byte {
 	if 0 <= i && i < nSmalls {
 		return small(int(i))
 	}
@@ -0,0 +1,57 @@
+package game
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// クライアントに渡すアイテムの一覧。
+// Version はアイテムの定義だけから決まるので、定義が変わったかどうかの判定に使える
+type Catalog struct {
+	Version string        `json:"version"`
+	Items   []CatalogItem `json:"items"`
+}
+
+// アイテムの定義と、1 個目から len(Power) 個目までの生産力と価格
+type CatalogItem struct {
+	MItem
+	Power []Exponential `json:"power"`
+	Price []Exponential `json:"price"`
+}
+
+// ItemID の順に並べたアイテムの定義のハッシュ
+func CatalogVersion(mItems map[int]MItem) string {
+	list := make([]MItem, 0, len(mItems))
+	for _, itemID := range SortedItemIDs(mItems) {
+		list = append(list, mItems[itemID])
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+// mItems の 1 個目から ordinals 個目までを載せた Catalog を作る
+func NewCatalog(mItems map[int]MItem, ordinals int) Catalog {
+	c := Catalog{
+		Version: CatalogVersion(mItems),
+		Items:   make([]CatalogItem, 0, len(mItems)),
+	}
+	for _, itemID := range SortedItemIDs(mItems) {
+		item := mItems[itemID]
+		ci := CatalogItem{
+			MItem: item,
+			Power: make([]Exponential, ordinals),
+			Price: make([]Exponential, ordinals),
+		}
+		for i := 0; i < ordinals; i++ {
+			ci.Power[i] = Big2Exp(item.GetPower(i + 1))
+			ci.Price[i] = Big2Exp(item.GetPrice(i + 1))
+		}
+		c.Items = append(c.Items, ci)
+	}
+	return c
+}
@@ -0,0 +1,35 @@
+package game
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	x := MItem{
+		ItemID: 1,
+		Power1: 1, Power2: 2, Power3: 2, Power4: 3,
+		Price1: 5, Price2: 4, Price3: 3, Price4: 2,
+	}
+	mItems, err := NewItems([]MItem{x})
+	assert.Nil(err)
+
+	c := NewCatalog(mItems, 3)
+	assert.Len(c.Items, 1)
+	assert.Equal(1, c.Items[0].ItemID)
+	assert.Len(c.Items[0].Power, 3)
+	assert.Equal(Exponential{81, 0}, c.Items[0].Power[0])
+	assert.Equal(Exponential{2048, 0}, c.Items[0].Price[0])
+
+	// 値が同じなら同じバージョンになり、定義が変わればバージョンも変わる
+	same, err := NewItems([]MItem{x})
+	assert.Nil(err)
+	assert.Equal(c.Version, CatalogVersion(same))
+	x.Price4 = 3
+	changed, err := NewItems([]MItem{x})
+	assert.Nil(err)
+	assert.NotEqual(c.Version, CatalogVersion(changed))
+}
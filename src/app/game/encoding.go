@@ -0,0 +1,288 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Exponential を JSON にするときの表現
+type Encoding string
+
+const (
+	EncodingArray          Encoding = "array"           // [仮数部, 指数部]
+	EncodingScientific     Encoding = "scientific"      // "1.2345e67"
+	EncodingRoundedDecimal Encoding = "rounded_decimal" // "12345000...0"。仮数部の15桁より下は 0 で埋めるので正確な値ではない
+	EncodingSI             Encoding = "si"              // "12.34k"。表示用で上位4桁しか残らない
+)
+
+// 仮数部の有効桁数。Big2Exp はこの桁数まで残す
+const mantissaDigits = 15
+
+// 3桁ごとの SI 接頭辞。これより大きい値は "1.5e33" のように書く
+var siSuffixes = []string{"", "k", "M", "G", "T", "P", "E", "Z", "Y", "R", "Q"}
+
+// 名前から Encoding を返す。空なら EncodingArray
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(s); e {
+	case "":
+		return EncodingArray, nil
+	case EncodingArray, EncodingScientific, EncodingRoundedDecimal, EncodingSI:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q", s)
+}
+
+// enc の表現で JSON にする
+func (n Exponential) Encode(enc Encoding) []byte {
+	if enc == "" || enc == EncodingArray {
+		b, _ := n.MarshalJSON()
+		return b
+	}
+	return strconv.AppendQuote(nil, n.Format(enc))
+}
+
+// enc の表現で文字列にする。EncodingArray なら JSON と同じ "[仮数部,指数部]"
+func (n Exponential) Format(enc Encoding) string {
+	if enc == "" || enc == EncodingArray {
+		b, _ := n.MarshalJSON()
+		return string(b)
+	}
+	sign, d, exp := n.digits()
+	if d == "" {
+		return "0"
+	}
+	switch enc {
+	case EncodingScientific:
+		s := sign + d[:1]
+		if 1 < len(d) {
+			s += "." + d[1:]
+		}
+		return s + "e" + strconv.FormatInt(exp+int64(len(d))-1, 10)
+	case EncodingRoundedDecimal:
+		// 仮数部の15桁より下の桁は失われているので 0 で埋める。小数部は切り捨てる
+		if exp < 0 {
+			if int64(len(d)) <= -exp {
+				return "0"
+			}
+			return sign + d[:int64(len(d))+exp]
+		}
+		return sign + d + strings.Repeat("0", int(exp))
+	case EncodingSI:
+		return sign + formatSI(d, exp)
+	}
+	panic("unknown encoding " + string(enc))
+}
+
+// 符号と、先頭と末尾の 0 を除いた仮数部の10進数と、それに掛ける10の指数を返す。0 なら d は空
+func (n Exponential) digits() (sign, d string, exp int64) {
+	if n.Mantissa == 0 {
+		return "", "", 0
+	}
+	d = strconv.FormatInt(n.Mantissa, 10)
+	if d[0] == '-' {
+		sign, d = "-", d[1:]
+	}
+	trimmed := strings.TrimRight(d, "0")
+	return sign, trimmed, n.Exponent + int64(len(d)-len(trimmed))
+}
+
+// d * 10^exp を上位4桁まで切り捨てて SI 接頭辞を付ける
+func formatSI(d string, exp int64) string {
+	top := exp + int64(len(d)) - 1 // 先頭の桁の位
+	if top < 0 {
+		return "0"
+	}
+	group := top / 3
+	intDigits := int(top-group*3) + 1
+
+	sig := d
+	if len(sig) < intDigits {
+		sig += strings.Repeat("0", intDigits-len(sig))
+	}
+	if 4 < len(sig) {
+		sig = sig[:4]
+	}
+	s := sig[:intDigits]
+	if frac := strings.TrimRight(sig[intDigits:], "0"); frac != "" {
+		s += "." + frac
+	}
+	if group < int64(len(siSuffixes)) {
+		return s + siSuffixes[group]
+	}
+	return s + "e" + strconv.FormatInt(group*3, 10)
+}
+
+// Format の EncodingScientific, EncodingRoundedDecimal, EncodingSI の文字列を読む。
+// 仮数部は Big2Exp と同じく上位15桁まで切り捨てる
+func ParseExponential(s string) (Exponential, error) {
+	orig := s
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+
+	var exp int64
+	for i := len(siSuffixes) - 1; 0 < i; i-- {
+		if strings.HasSuffix(s, siSuffixes[i]) {
+			s = strings.TrimSuffix(s, siSuffixes[i])
+			exp = int64(i) * 3
+			break
+		}
+	}
+	if i := strings.IndexAny(s, "eE"); 0 <= i {
+		e, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return Exponential{}, fmt.Errorf("invalid exponential %q", orig)
+		}
+		if err := checkExponent(e); err != nil {
+			return Exponential{}, err
+		}
+		exp += e
+		s = s[:i]
+	}
+	d := s
+	if i := strings.IndexByte(s, '.'); 0 <= i {
+		d = s[:i] + s[i+1:]
+		exp -= int64(len(s) - i - 1)
+	}
+	if d == "" || strings.Trim(d, "0123456789") != "" {
+		return Exponential{}, fmt.Errorf("invalid exponential %q", orig)
+	}
+
+	d = strings.TrimLeft(d, "0")
+	trimmed := strings.TrimRight(d, "0")
+	exp += int64(len(d) - len(trimmed))
+	x := normalizeDigits(sign, trimmed, exp)
+	if err := checkExponent(x.Exponent); err != nil {
+		return Exponential{}, err
+	}
+	return x, nil
+}
+
+// 先頭と末尾の 0 を除いた d * 10^exp を Big2Exp と同じ形にする。
+// 15桁に収まる整数は指数部 0、それより大きい値は仮数部を15桁にする
+func normalizeDigits(sign, d string, exp int64) Exponential {
+	top := exp + int64(len(d)) // 整数部の桁数
+	if d == "" || top <= 0 {
+		return Exponential{}
+	}
+	var e int64
+	if mantissaDigits < top {
+		e = top - mantissaDigits
+	}
+	// d * 10^exp / 10^e を15桁までの整数にする
+	shift := exp - e
+	if shift < 0 {
+		d = d[:int64(len(d))+shift]
+	} else {
+		d += strings.Repeat("0", int(shift))
+	}
+	m, _ := strconv.ParseInt(sign+d, 10, 64)
+	return Exponential{m, e}
+}
+
+// 表現を指定して JSON にする Exponential
+type encodedExp struct {
+	n   Exponential
+	enc Encoding
+}
+
+func (x encodedExp) MarshalJSON() ([]byte, error) {
+	return x.n.Encode(x.enc), nil
+}
+
+func encodeExps(ns []Exponential, enc Encoding) []encodedExp {
+	xs := make([]encodedExp, len(ns))
+	for i, n := range ns {
+		xs[i] = encodedExp{n, enc}
+	}
+	return xs
+}
+
+// Status を、Exponential を enc の表現にして JSON にする
+func (s *Status) Encode(enc Encoding) ([]byte, error) {
+	if enc == "" || enc == EncodingArray {
+		return json.Marshal(s)
+	}
+
+	type schedule struct {
+		Time       int64      `json:"time"`
+		MilliIsu   encodedExp `json:"milli_isu"`
+		TotalPower encodedExp `json:"total_power"`
+	}
+	type building struct {
+		Time       int64      `json:"time"`
+		CountBuilt int        `json:"count_built"`
+		Power      encodedExp `json:"power"`
+	}
+	type item struct {
+		ItemID      int        `json:"item_id"`
+		CountBought int        `json:"count_bought"`
+		CountBuilt  int        `json:"count_built"`
+		NextPrice   encodedExp `json:"next_price"`
+		Power       encodedExp `json:"power"`
+		Building    []building `json:"building"`
+	}
+	x := struct {
+		Time     int64      `json:"time"`
+		Adding   []Adding   `json:"adding"`
+		Schedule []schedule `json:"schedule"`
+		Items    []item     `json:"items"`
+		OnSale   []OnSale   `json:"on_sale"`
+	}{
+		Time:   s.Time,
+		Adding: s.Adding,
+		OnSale: s.OnSale,
+	}
+	if s.Schedule != nil {
+		x.Schedule = make([]schedule, len(s.Schedule))
+	}
+	for i, sc := range s.Schedule {
+		x.Schedule[i] = schedule{sc.Time, encodedExp{sc.MilliIsu, enc}, encodedExp{sc.TotalPower, enc}}
+	}
+	if s.Items != nil {
+		x.Items = make([]item, len(s.Items))
+	}
+	for i, it := range s.Items {
+		x.Items[i] = item{
+			ItemID:      it.ItemID,
+			CountBought: it.CountBought,
+			CountBuilt:  it.CountBuilt,
+			NextPrice:   encodedExp{it.NextPrice, enc},
+			Power:       encodedExp{it.Power, enc},
+		}
+		if it.Building != nil {
+			x.Items[i].Building = make([]building, len(it.Building))
+		}
+		for j, b := range it.Building {
+			x.Items[i].Building[j] = building{b.Time, b.CountBuilt, encodedExp{b.Power, enc}}
+		}
+	}
+	return json.Marshal(x)
+}
+
+// Catalog を、Exponential を enc の表現にして JSON にする
+func (c Catalog) Encode(enc Encoding) ([]byte, error) {
+	if enc == "" || enc == EncodingArray {
+		return json.Marshal(c)
+	}
+
+	type item struct {
+		MItem
+		Power []encodedExp `json:"power"`
+		Price []encodedExp `json:"price"`
+	}
+	x := struct {
+		Version string `json:"version"`
+		Items   []item `json:"items"`
+	}{
+		Version: c.Version,
+		Items:   make([]item, len(c.Items)),
+	}
+	for i, ci := range c.Items {
+		x.Items[i] = item{ci.MItem, encodeExps(ci.Power, enc), encodeExps(ci.Price, enc)}
+	}
+	return json.Marshal(x)
+}
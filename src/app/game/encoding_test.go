@@ -0,0 +1,174 @@
+package game
+
+import (
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 1 から 10^300 くらいまでの値
+func encodingTestValues() []*big.Int {
+	ns := []*big.Int{
+		big.NewInt(0),
+		big.NewInt(1),
+		big.NewInt(999),
+		big.NewInt(123456789012345),
+		big.NewInt(999999999999999),
+		big.NewInt(1000000000000000),
+		big.NewInt(1234567890123456789),
+		Str2Big("18446744073709551617"),
+		Str2Big("123456789012345678901234567890"),
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		n := new(big.Int).Exp(big.NewInt(10), big.NewInt(r.Int63n(300)), nil)
+		n.Mul(n, big.NewInt(r.Int63n(1000000)+1))
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func TestExponentialFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, c := range []struct {
+		n                   Exponential
+		scientific, decimal string
+		si                  string
+	}{
+		{Exponential{0, 0}, "0", "0", "0"},
+		{Exponential{7, 0}, "7e0", "7", "7"},
+		{Exponential{999, 0}, "9.99e2", "999", "999"},
+		{Exponential{12345, 0}, "1.2345e4", "12345", "12.34k"},
+		{Exponential{1234567, 0}, "1.234567e6", "1234567", "1.234M"},
+		{Exponential{100000000000000, 1}, "1e15", "1000000000000000", "1P"},
+		{Exponential{123450000000000, 53}, "1.2345e67", "12345" + strings.Repeat("0", 63), "12.34e66"},
+		{Exponential{15, 32}, "1.5e33", "15" + strings.Repeat("0", 32), "1.5e33"},
+	} {
+		assert.Equal(c.scientific, c.n.Format(EncodingScientific))
+		assert.Equal(c.decimal, c.n.Format(EncodingRoundedDecimal))
+		assert.Equal(c.si, c.n.Format(EncodingSI))
+	}
+	// 15桁より下の桁は残らない
+	assert.Equal("12345678901234500000", Big2Exp(Str2Big("12345678901234567890")).Format(EncodingRoundedDecimal))
+	assert.Equal("[12345,0]", Exponential{12345, 0}.Format(EncodingArray))
+	assert.Equal(`"1.2345e4"`, string(Exponential{12345, 0}.Encode(EncodingScientific)))
+}
+
+// Big2Exp の結果を書いて読み直すと元に戻る。SI は上位4桁まで
+func TestExponentialRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, n := range encodingTestValues() {
+		x := Big2Exp(n)
+		for _, enc := range []Encoding{EncodingScientific, EncodingRoundedDecimal} {
+			s := x.Format(enc)
+			y, err := ParseExponential(s)
+			assert.Nil(err, s)
+			assert.Equal(x, y, "%s %s", enc, s)
+		}
+
+		s := x.Format(EncodingSI)
+		y, err := ParseExponential(s)
+		assert.Nil(err, s)
+		if n.Sign() == 0 {
+			assert.Equal(Exponential{}, y)
+			continue
+		}
+		// 切り捨てた分の誤差は 0.1% 未満
+		diff := new(big.Float).SetInt(n)
+		diff.Sub(diff, expToFloat(y))
+		diff.Quo(diff, new(big.Float).SetInt(n))
+		f, _ := diff.Float64()
+		assert.True(-1e-12 < f && f < 1e-3, "%s: %s => %f", n, s, f)
+	}
+
+	for _, s := range []string{"", "e3", "1.2.3", "12x", "1e", "1e1000000000000", "1e100000100"} {
+		_, err := ParseExponential(s)
+		assert.NotNil(err, s)
+	}
+
+	// 10^Exponent を作らなくて済むように、大きすぎる指数部は読まない
+	var x Exponential
+	assert.NotNil(json.Unmarshal([]byte("[1,1000000000000]"), &x))
+	assert.NotNil(json.Unmarshal([]byte("[1,-1000000000000]"), &x))
+	assert.NotNil(json.Unmarshal([]byte(`"1e1000000000000"`), &x))
+	assert.Nil(json.Unmarshal([]byte("[1,1000]"), &x))
+	assert.Equal(Exponential{1, 1000}, x)
+}
+
+func TestStatusEncode(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewState(defaultItems, 0)
+	s.AddIsu(0, Str2Big("123456789012345678901234567890"))
+	s.Buy(Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	status := s.Status(DefaultHorizon)
+
+	b, err := status.Encode(EncodingArray)
+	assert.Nil(err)
+	expected, err := json.Marshal(status)
+	assert.Nil(err)
+	assert.Equal(expected, b)
+
+	b, err = status.Encode(EncodingScientific)
+	assert.Nil(err)
+	var x struct {
+		Schedule []struct {
+			MilliIsu string `json:"milli_isu"`
+		} `json:"schedule"`
+		Items []struct {
+			NextPrice string `json:"next_price"`
+			Building  []struct {
+				Power string `json:"power"`
+			} `json:"building"`
+		} `json:"items"`
+	}
+	assert.Nil(json.Unmarshal(b, &x))
+	assert.Equal(status.Schedule[0].MilliIsu.Format(EncodingScientific), x.Schedule[0].MilliIsu)
+	assert.Equal(status.Items[0].NextPrice.Format(EncodingScientific), x.Items[0].NextPrice)
+
+	c := NewCatalog(defaultItems, 2)
+	b, err = c.Encode(EncodingRoundedDecimal)
+	assert.Nil(err)
+	var y struct {
+		Items []struct {
+			ItemID int      `json:"item_id"`
+			Price  []string `json:"price"`
+		} `json:"items"`
+	}
+	assert.Nil(json.Unmarshal(b, &y))
+	assert.Equal(c.Items[0].Price[1].Format(EncodingRoundedDecimal), y.Items[0].Price[1])
+}
+
+func expToFloat(n Exponential) *big.Float {
+	f := new(big.Float).SetInt64(n.Mantissa)
+	return f.Mul(f, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(n.Exponent), nil)))
+}
+
+// 書いた Status を読み直すと元に戻る
+func TestStatusUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewState(defaultItems, 0)
+	s.AddIsu(0, Str2Big("123456789012345678901234567890"))
+	s.Buy(Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	s.Buy(Buying{ItemID: 2, Ordinal: 1, Time: 10})
+	status := s.Status(DefaultHorizon)
+
+	for _, enc := range []Encoding{EncodingArray, EncodingScientific, EncodingRoundedDecimal} {
+		b, err := status.Encode(enc)
+		assert.Nil(err)
+		var x Status
+		assert.Nil(json.Unmarshal(b, &x), enc)
+		assert.Equal(status, &x, enc)
+	}
+
+	var n Exponential
+	assert.NotNil(json.Unmarshal([]byte(`{"mantissa": 1}`), &n))
+	assert.NotNil(json.Unmarshal([]byte(`"1.2.3"`), &n))
+}
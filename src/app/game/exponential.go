@@ -0,0 +1,266 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// 10進数の指数表記に使うデータ。JSONでは [仮数部, 指数部] という2要素配列になる。
+// 読むときは Format で書いた文字列も受け付ける。
+type Exponential struct {
+	// Mantissa * 10 ^ Exponent
+	Mantissa int64
+	Exponent int64
+}
+
+// JSON や文字列から読める指数部の絶対値の上限。
+// Int と Float は 10^Exponent を作るので、これを超える値は読まずにエラーにする
+const MaxExponent = 100000000
+
+func checkExponent(e int64) error {
+	if e < -MaxExponent || MaxExponent < e {
+		return fmt.Errorf("exponent %d is out of range", e)
+	}
+	return nil
+}
+
+func (n Exponential) MarshalJSON() ([]byte, error) {
+	bufmat := formatInt(n.Mantissa)
+	bufexp := formatInt(n.Exponent)
+	lmat := len(bufmat)
+	lexp := len(bufexp)
+	result := make([]byte, lmat+3+lexp)
+	result[0] = '['
+	copy(result[1:lmat+1], bufmat)
+	result[lmat+1] = ','
+	copy(result[lmat+2:len(result)-1], bufexp)
+	result[len(result)-1] = ']'
+	return result, nil
+}
+
+// 10進数の文字列を big.Int にする。不正な文字列なら 0
+func Str2Big(s string) *big.Int {
+	x := new(big.Int)
+	x.SetString(s, 10)
+	return x
+}
+
+// 桁数が増えても大丈夫なBigintのDiv
+func customBigIntDiv(a *big.Int, b *big.Int) int64 {
+	alen := len(a.Bits())
+	if alen < 4 {
+		return big.NewInt(0).Div(a, b).Int64()
+	}
+	an := big.NewInt(0).SetBits(a.Bits()[alen-3:])
+	bn := big.NewInt(0).SetBits(b.Bits()[alen-3:])
+	return big.NewInt(0).Div(an, bn).Int64()
+}
+
+// int64をそのまま文字列化すると15桁以上になりうるので調整が必要
+func int64ToExponential(significand, exponent int64) Exponential {
+	var addketa int64
+	var divten int64
+	if significand < 1000000000000000 {
+		addketa, divten = 0, 1
+	} else if significand < 10000000000000000 {
+		addketa, divten = 1, 10
+	} else if significand < 100000000000000000 {
+		addketa, divten = 2, 100
+	} else if significand < 1000000000000000000 {
+		addketa, divten = 3, 1000
+	} else {
+		addketa, divten = 4, 10000
+	}
+	return Exponential{significand / divten, exponent + addketa}
+}
+
+func setupTenCache() []big.Int {
+	var tenCache = make([]big.Int, 50000) // メモリに応じて適宜調整のこと
+	bigTen := big.NewInt(10)
+	tenCache[0].Exp(bigTen, big.NewInt(int64(0)), nil)
+	for i := 1; i < len(tenCache); i++ {
+		tenCache[i].Mul(bigTen, &tenCache[i-1])
+	}
+	return tenCache
+}
+
+var tenCache = setupTenCache()
+var ten = big.NewInt(10)
+
+// 上位15桁ほどを残した指数表記にする
+func Big2Exp(n *big.Int) Exponential {
+	if n.IsInt64() {
+		return int64ToExponential(n.Int64(), 0)
+	}
+	w := n.Bits()
+	var w1, w2 float64 // 上のケタ, 下のケタ
+	bef := len(w) - 2
+	if len(w) == 1 {
+		// int64 に収まらない 1 ワードの値
+		w2 = float64(w[0])
+		bef = 0
+	} else {
+		w1 = float64(w[len(w)-1])
+		w2 = float64(w[len(w)-2])
+	}
+	log10ed := math.Log10(2) * 64 * float64(bef)
+	log10ed += math.Log10(float64(1<<64)*w1 + w1 + w2)
+	keta := int64(log10ed - 14.0)
+	if keta < int64(len(tenCache)) {
+		ketaInt := &tenCache[keta]
+		significand := customBigIntDiv(n, ketaInt)
+		return int64ToExponential(significand, keta)
+	} else {
+		ketaInt := big.NewInt(0).Exp(ten, big.NewInt(keta), nil)
+		significand := customBigIntDiv(n, ketaInt)
+		return int64ToExponential(significand, keta)
+	}
+}
+
+// [仮数部, 指数部] の配列か、Format で書いた文字列を読む
+func (n *Exponential) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		x, err := ParseExponential(s)
+		if err != nil {
+			return err
+		}
+		*n = x
+		return nil
+	}
+
+	var a [2]int64
+	if err := json.Unmarshal(b, &a); err != nil {
+		return fmt.Errorf("invalid exponential %s", b)
+	}
+	if err := checkExponent(a[1]); err != nil {
+		return err
+	}
+	*n = Exponential{a[0], a[1]}
+	return nil
+}
+
+// Big2Exp と同じ形にする。15桁に収まる整数は指数部 0、それより大きい値は仮数部を15桁に切り捨てる
+func (n Exponential) Normalize() Exponential {
+	sign, d, exp := n.digits()
+	return normalizeDigits(sign, d, exp)
+}
+
+// n と y を比べて、n < y なら -1、n == y なら 0、n > y なら 1 を返す
+func (n Exponential) Cmp(y Exponential) int {
+	ns, nd, nexp := n.digits()
+	ys, yd, yexp := y.digits()
+	sign := func(s, d string) int {
+		switch {
+		case d == "":
+			return 0
+		case s == "-":
+			return -1
+		}
+		return 1
+	}
+	if a, b := sign(ns, nd), sign(ys, yd); a < b {
+		return -1
+	} else if b < a {
+		return 1
+	} else if a == 0 {
+		return 0
+	}
+
+	// 絶対値を比べる。桁数が同じなら先頭の桁から比べればよい
+	c := 0
+	ntop, ytop := nexp+int64(len(nd)), yexp+int64(len(yd))
+	switch {
+	case ntop < ytop:
+		c = -1
+	case ytop < ntop:
+		c = 1
+	default:
+		c = strings.Compare(nd, yd)
+	}
+	if ns == "-" {
+		return -c
+	}
+	return c
+}
+
+// n + y を計算して Normalize した値を返す。
+// 先頭の桁が仮数部の桁数より離れていれば、小さい方は無視して大きい方を返す
+func (n Exponential) Add(y Exponential) Exponential {
+	_, nd, nexp := n.digits()
+	_, yd, yexp := y.digits()
+	ntop, ytop := nexp+int64(len(nd)), yexp+int64(len(yd))
+	switch {
+	case yd == "" || (nd != "" && mantissaDigits < ntop-ytop):
+		return n.Normalize()
+	case nd == "" || mantissaDigits < ytop-ntop:
+		return y.Normalize()
+	}
+
+	exp := n.Exponent
+	if y.Exponent < exp {
+		exp = y.Exponent
+	}
+	a := scaleBig(big.NewInt(n.Mantissa), n.Exponent-exp)
+	b := scaleBig(big.NewInt(y.Mantissa), y.Exponent-exp)
+	return bigToExp(a.Add(a, b), exp)
+}
+
+// n * y を計算して Normalize した値を返す
+func (n Exponential) Mul(y Exponential) Exponential {
+	m := new(big.Int).Mul(big.NewInt(n.Mantissa), big.NewInt(y.Mantissa))
+	return bigToExp(m, n.Exponent+y.Exponent)
+}
+
+// Mantissa * 10^Exponent を big.Int にする。小数部は切り捨てる。
+// 10^Exponent を作るので、外から受け取った値は UnmarshalJSON か ParseExponential で読んだものに限る
+func (n Exponential) Int() *big.Int {
+	if n.Exponent < 0 {
+		return new(big.Int).Quo(big.NewInt(n.Mantissa), pow10(-n.Exponent))
+	}
+	return scaleBig(big.NewInt(n.Mantissa), n.Exponent)
+}
+
+// Mantissa * 10^Exponent を big.Float にする。指数部が 0 以上なら誤差は無い
+func (n Exponential) Float() *big.Float {
+	if n.Exponent < 0 {
+		f := new(big.Float).SetInt64(n.Mantissa)
+		return f.Quo(f, new(big.Float).SetInt(pow10(-n.Exponent)))
+	}
+	return new(big.Float).SetInt(n.Int())
+}
+
+// big.Float の整数部を Normalize した Exponential にする
+func Float2Exp(f *big.Float) Exponential {
+	i, _ := f.Int(nil)
+	return bigToExp(i, 0)
+}
+
+// m * 10^exp を Normalize した Exponential にする
+func bigToExp(m *big.Int, exp int64) Exponential {
+	sign, d := "", m.String()
+	if d[0] == '-' {
+		sign, d = "-", d[1:]
+	}
+	d = strings.TrimLeft(d, "0")
+	trimmed := strings.TrimRight(d, "0")
+	return normalizeDigits(sign, trimmed, exp+int64(len(d)-len(trimmed)))
+}
+
+func pow10(e int64) *big.Int {
+	if e < int64(len(tenCache)) {
+		return &tenCache[e]
+	}
+	return new(big.Int).Exp(ten, big.NewInt(e), nil)
+}
+
+// x * 10^e を返す。x を書き換える
+func scaleBig(x *big.Int, e int64) *big.Int {
+	if e == 0 {
+		return x
+	}
+	return x.Mul(x, pow10(e))
+}
@@ -0,0 +1,57 @@
+package game
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialArithmetic(t *testing.T) {
+	assert := assert.New(t)
+
+	values := encodingTestValues()
+	for i, a := range values {
+		b := values[(i*7+3)%len(values)]
+		x, y := Big2Exp(a), Big2Exp(b)
+
+		assert.Equal(x, x.Normalize())
+		assert.Equal(a.Cmp(b), x.Cmp(y), "%s %s", a, b)
+		assert.Equal(0, x.Cmp(x))
+		neg := Exponential{-x.Mantissa, x.Exponent}
+		if x.Mantissa != 0 {
+			assert.Equal(-1, neg.Cmp(x))
+		}
+
+		sum := new(big.Int).Add(x.Int(), y.Int())
+		assert.Equal(bigToExp(sum, 0), x.Add(y))
+		prod := new(big.Int).Mul(x.Int(), y.Int())
+		assert.Equal(bigToExp(prod, 0), x.Mul(y))
+
+		assert.Equal(x, Float2Exp(x.Float()), "%s", a)
+	}
+
+	assert.Equal(Exponential{3, 0}, Exponential{12, -1}.Add(Exponential{18, -1}))
+	assert.Equal(Exponential{100000000000000, 1}, Exponential{999999999999999, 0}.Add(Exponential{1, 0}))
+	assert.Equal(Exponential{-5, 0}, Exponential{5, 0}.Add(Exponential{-1, 1}))
+	assert.Equal(Exponential{123456789012345, 4}, Exponential{1234567890123456789, 0}.Normalize())
+	assert.Equal(-1, Exponential{99, 0}.Cmp(Exponential{1, 2}))
+	assert.Equal(1, Exponential{-99, 0}.Cmp(Exponential{-1, 2}))
+	assert.Equal("1", Exponential{15, -1}.Int().String())
+
+	// 先頭の桁が15桁より離れていれば小さい方は無視する
+	assert.Equal(Exponential{100000000000000, 999999999999986}, Exponential{1, 1000000000000000}.Add(Exponential{5, 0}))
+	assert.Equal(Exponential{-5, 0}, Exponential{0, 1000000000000000}.Add(Exponential{-5, 0}))
+	assert.Equal(Exponential{100000000000000, 2}, Exponential{1, 16}.Add(Exponential{9, 0}))
+	assert.Equal(Exponential{100000000000000, 3}, Exponential{1, 17}.Add(Exponential{9, 0}))
+}
+
+// int64 に収まらない 1 ワードの値も上位15桁が残る
+func TestBig2ExpOneWord(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(Exponential{922337203685477, 4}, Big2Exp(Str2Big("9223372036854775808")))
+	assert.Equal(Exponential{184467440737095, 5}, Big2Exp(Str2Big("18446744073709551615")))
+	assert.Equal(Exponential{922337203685477, 4}, Big2Exp(big.NewInt(math.MaxInt64)))
+}
@@ -0,0 +1,216 @@
+package game
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Formula の expr で書ける式の最大の長さ
+const maxExprLen = 256
+
+// x と整数、+ - * / % ^ と括弧だけを使う式。
+// / と % は 0 に向かって切り捨て、0 で割ると 0 になる。負の指数の ^ も 0 になる
+type exprNode interface {
+	eval(x *big.Int) (*big.Int, error)
+}
+
+type exprNum struct{ v *big.Int }
+type exprVar struct{}
+type exprNeg struct{ a exprNode }
+type exprBin struct {
+	op   byte
+	a, b exprNode
+}
+
+func (n exprNum) eval(x *big.Int) (*big.Int, error) { return new(big.Int).Set(n.v), nil }
+func (exprVar) eval(x *big.Int) (*big.Int, error)   { return new(big.Int).Set(x), nil }
+
+func (n exprNeg) eval(x *big.Int) (*big.Int, error) {
+	a, err := n.a.eval(x)
+	if err != nil {
+		return nil, err
+	}
+	return a.Neg(a), nil
+}
+
+func (n exprBin) eval(x *big.Int) (*big.Int, error) {
+	a, err := n.a.eval(x)
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.b.eval(x)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case '+':
+		a.Add(a, b)
+	case '-':
+		a.Sub(a, b)
+	case '*':
+		if maxFormulaBits < a.BitLen()+b.BitLen()-1 {
+			return nil, errFormulaTooLarge
+		}
+		a.Mul(a, b)
+	case '/':
+		if b.Sign() == 0 {
+			return a.SetInt64(0), nil
+		}
+		a.Quo(a, b)
+	case '%':
+		if b.Sign() == 0 {
+			return a.SetInt64(0), nil
+		}
+		a.Rem(a, b)
+	case '^':
+		if b.Sign() < 0 {
+			return a.SetInt64(0), nil
+		}
+		if err := checkPow(a, b); err != nil {
+			return nil, err
+		}
+		if a.BitLen() <= 1 && 0 < b.Sign() {
+			// 0, 1, -1 の累乗は b の偶奇だけで決まる
+			b.SetInt64(2 - int64(b.Bit(0)))
+		}
+		a.Exp(a, b, nil)
+	default:
+		panic("unknown operator " + string(n.op))
+	}
+	if maxFormulaBits < a.BitLen() {
+		return nil, errFormulaTooLarge
+	}
+	return a, nil
+}
+
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func parseExpr(s string) (exprNode, error) {
+	if len(s) > maxExprLen {
+		return nil, fmt.Errorf("expr is longer than %d bytes", maxExprLen)
+	}
+	p := &exprParser{s: s}
+	n, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, fmt.Errorf("unexpected %q at %d in expr", p.peek(), p.pos)
+	}
+	return n, nil
+}
+
+// 空白を読み飛ばして次の文字を返す。終わりなら 0
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// sum := product (('+' | '-') product)*
+func (p *exprParser) sum() (exprNode, error) {
+	a, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return a, nil
+		}
+		p.pos++
+		b, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		a = exprBin{op, a, b}
+	}
+}
+
+// product := unary (('*' | '/' | '%') unary)*
+func (p *exprParser) product() (exprNode, error) {
+	a, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return a, nil
+		}
+		p.pos++
+		b, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		a = exprBin{op, a, b}
+	}
+}
+
+// unary := '-' unary | power
+func (p *exprParser) unary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		a, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNeg{a}, nil
+	}
+	return p.power()
+}
+
+// power := primary ('^' unary)?
+func (p *exprParser) power() (exprNode, error) {
+	a, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '^' {
+		return a, nil
+	}
+	p.pos++
+	b, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return exprBin{'^', a, b}, nil
+}
+
+// primary := number | 'x' | '(' sum ')'
+func (p *exprParser) primary() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 'x':
+		p.pos++
+		return exprVar{}, nil
+	case c == '(':
+		p.pos++
+		a, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at %d in expr", p.pos)
+		}
+		p.pos++
+		return a, nil
+	case '0' <= c && c <= '9':
+		start := p.pos
+		for p.pos < len(p.s) && '0' <= p.s[p.pos] && p.s[p.pos] <= '9' {
+			p.pos++
+		}
+		v, _ := new(big.Int).SetString(p.s[start:p.pos], 10)
+		return exprNum{v}, nil
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expr")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in expr", c, p.pos)
+}
@@ -0,0 +1,126 @@
+package game
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+)
+
+// 買っていない次の1個から Ordinal 個目までをまとめて買えるようになる時刻
+type Affordable struct {
+	ItemID  int         `json:"item_id"`
+	Ordinal int         `json:"ordinal"`
+	Price   Exponential `json:"price"` // Ordinal 個目だけの価格
+	Time    int64       `json:"time"`  // 今の生産力と予定の adding, buying では買えないなら -1
+}
+
+// 時刻 Time から見た、各アイテムの次の何個かが買えるようになる時刻
+type Forecast struct {
+	Time  int64        `json:"time"`
+	Items []Affordable `json:"items"`
+}
+
+// 各アイテムの次の ordinals 個について、k 個目までをまとめて買えるようになる時刻を求める。
+// k 個目の時刻には 1 個目から k-1 個目までの価格も含み、途中で買った分の生産力は含めない。
+// 予定の adding, buying と selling は全て反映し、それ以外には何も買わないものとする
+func (s *State) Forecast(ordinals int) *Forecast {
+	type target struct {
+		i    int      // Items の添字
+		need *big.Int // それまでの価格の合計 * 1000
+	}
+	f := &Forecast{Time: s.time, Items: []Affordable{}}
+	targets := []target{}
+	for _, itemID := range s.itemIDs {
+		m := s.mItems[itemID]
+		total := new(big.Int)
+		for k := 1; k <= ordinals; k++ {
+			ordinal := s.bought[itemID] + k
+			price := m.GetPrice(ordinal)
+			total.Add(total, price)
+			f.Items = append(f.Items, Affordable{ItemID: itemID, Ordinal: ordinal, Price: Big2Exp(price), Time: -1})
+			targets = append(targets, target{len(f.Items) - 1, new(big.Int).Mul(total, big1000)})
+		}
+	}
+
+	milliIsu := new(big.Int).Set(s.milliIsu)
+	power := new(big.Int).Set(s.power)
+	cur := s.time
+	next := 0
+	for {
+		// 時刻 cur の時点で買えるものを記録する
+		rest := targets[:0]
+		for _, x := range targets {
+			if 0 <= milliIsu.Cmp(x.need) {
+				f.Items[x.i].Time = cur
+			} else {
+				rest = append(rest, x)
+			}
+		}
+		targets = rest
+		if len(targets) == 0 {
+			break
+		}
+
+		// 次の adding, buying までの区間では毎ミリ秒 power ずつ増えるだけなので割り算で求まる
+		segEnd := int64(math.MaxInt64)
+		if next < len(s.pending) {
+			segEnd = s.pending[next].time - 1
+		}
+		rest = targets[:0]
+		for _, x := range targets {
+			if t, ok := reachTime(milliIsu, power, cur, x.need); ok && t <= segEnd {
+				f.Items[x.i].Time = t
+			} else {
+				rest = append(rest, x)
+			}
+		}
+		targets = rest
+		if len(targets) == 0 || next == len(s.pending) {
+			break
+		}
+
+		t := segEnd + 1
+		milliIsu.Add(milliIsu, new(big.Int).Mul(power, big.NewInt(t-cur)))
+		cur = t
+		for ; next < len(s.pending) && s.pending[next].time == t; next++ {
+			e := s.pending[next]
+			switch {
+			case e.isu != nil:
+				milliIsu.Add(milliIsu, new(big.Int).Mul(e.isu, big1000))
+			case e.selling != nil:
+				m := s.mItems[e.selling.ItemID]
+				power.Sub(power, new(big.Int).Mul(m.GetPower(e.selling.Ordinal), s.speed))
+				milliIsu.Add(milliIsu, new(big.Int).Mul(Str2Big(e.selling.Refund), big1000))
+			default:
+				m := s.mItems[e.buying.ItemID]
+				power.Add(power, new(big.Int).Mul(m.GetPower(e.buying.Ordinal), s.speed))
+			}
+		}
+	}
+	return f
+}
+
+// Forecast を、Exponential を enc の表現にして JSON にする
+func (f *Forecast) Encode(enc Encoding) ([]byte, error) {
+	if enc == "" || enc == EncodingArray {
+		return json.Marshal(f)
+	}
+
+	type affordable struct {
+		ItemID  int        `json:"item_id"`
+		Ordinal int        `json:"ordinal"`
+		Price   encodedExp `json:"price"`
+		Time    int64      `json:"time"`
+	}
+	x := struct {
+		Time  int64        `json:"time"`
+		Items []affordable `json:"items"`
+	}{
+		Time:  f.Time,
+		Items: make([]affordable, len(f.Items)),
+	}
+	for i, a := range f.Items {
+		x.Items[i] = affordable{a.ItemID, a.Ordinal, encodedExp{a.Price, enc}, a.Time}
+	}
+	return json.Marshal(x)
+}
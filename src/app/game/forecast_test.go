@@ -0,0 +1,82 @@
+package game
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 予測した時刻にちょうど買えるようになる
+func TestForecast(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewState(defaultItems, 0)
+	s.AddIsu(0, big.NewInt(3))
+	s.Buy(Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	s.AddIsu(200, big.NewInt(5))
+	s.Buy(Buying{ItemID: 2, Ordinal: 1, Time: 300})
+	s.AddIsu(5000, Str2Big("1000000"))
+	s.Advance(100)
+
+	f := s.Forecast(3)
+	assert.Equal(int64(100), f.Time)
+	assert.Len(f.Items, len(defaultItems)*3)
+	reachable := 0
+	for _, a := range f.Items {
+		m := defaultItems[a.ItemID]
+		price := m.GetPrice(a.Ordinal)
+		assert.Equal(Big2Exp(price), a.Price)
+		assert.True(s.CountBought(a.ItemID) < a.Ordinal && a.Ordinal <= s.CountBought(a.ItemID)+3)
+		if a.Time < 0 {
+			continue
+		}
+		reachable++
+		// 次の1個から Ordinal 個目までの合計が貯まった時刻になる
+		total := new(big.Int)
+		for o := s.CountBought(a.ItemID) + 1; o <= a.Ordinal; o++ {
+			total.Add(total, m.GetPrice(o))
+		}
+		need := new(big.Int).Mul(total, big1000)
+		assert.True(0 <= s.MilliIsuAt(a.Time).Cmp(need), "item %d ordinal %d", a.ItemID, a.Ordinal)
+		if s.Time() < a.Time {
+			assert.True(s.MilliIsuAt(a.Time-1).Cmp(need) < 0, "item %d ordinal %d", a.ItemID, a.Ordinal)
+		}
+	}
+	assert.NotZero(reachable)
+
+	// 生産力が無ければ、予定の adding で足りない分は買えない
+	empty := NewState(defaultItems, 0)
+	empty.AddIsu(100, big.NewInt(10))
+	for _, a := range empty.Forecast(1).Items {
+		m := defaultItems[a.ItemID]
+		if m.GetPrice(1).Cmp(big.NewInt(10)) <= 0 {
+			assert.Equal(int64(100), a.Time)
+		} else {
+			assert.Equal(int64(-1), a.Time)
+		}
+	}
+
+	// 2個目は1個目の価格も合わせて貯まるまで買えない
+	m := defaultItems[1]
+	both := new(big.Int).Add(m.GetPrice(1), m.GetPrice(2))
+	poor := NewState(defaultItems, 0)
+	poor.AddIsu(100, new(big.Int).Sub(both, big.NewInt(1)))
+	poor.AddIsu(200, big.NewInt(1))
+	for _, a := range poor.Forecast(2).Items {
+		if a.ItemID == 1 {
+			assert.Equal(int64(a.Ordinal*100), a.Time, "ordinal %d", a.Ordinal)
+		}
+	}
+
+	b, err := f.Encode(EncodingScientific)
+	assert.Nil(err)
+	var x struct {
+		Items []struct {
+			Price string `json:"price"`
+		} `json:"items"`
+	}
+	assert.Nil(json.Unmarshal(b, &x))
+	assert.Equal(f.Items[0].Price.Format(EncodingScientific), x.Items[0].Price)
+}
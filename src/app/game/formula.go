@@ -0,0 +1,226 @@
+package game
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+const (
+	FormulaExp4        = "exp4"        // (C*x+1) * D^(A*x+B)
+	FormulaPolynomial  = "polynomial"  // Coefficients[0] + Coefficients[1]*x + Coefficients[2]*x^2 + ...
+	FormulaExponential = "exponential" // Scale * Base^x
+	FormulaPiecewise   = "piecewise"   // x 以下で最大の From を持つ Piece の式
+	FormulaCapped      = "capped"      // min(Of, Max)
+	FormulaExpr        = "expr"        // Expr に書いた式
+)
+
+// 式の計算途中と結果で許す最大のビット数 (10 進で約 19700 桁)。これを超える式はエラーになる
+const maxFormulaBits = 1 << 16
+
+var errFormulaTooLarge = fmt.Errorf("value exceeds %d bits", maxFormulaBits)
+
+// x 個目のアイテムの生産力か価格を決める式。Type ごとに使うフィールドが違う
+type Formula struct {
+	Type string `json:"type" yaml:"type"`
+
+	// exp4
+	A int64 `json:"a,omitempty" yaml:"a,omitempty"`
+	B int64 `json:"b,omitempty" yaml:"b,omitempty"`
+	C int64 `json:"c,omitempty" yaml:"c,omitempty"`
+	D int64 `json:"d,omitempty" yaml:"d,omitempty"`
+
+	// polynomial
+	Coefficients []int64 `json:"coefficients,omitempty" yaml:"coefficients,omitempty"`
+
+	// exponential
+	Scale int64 `json:"scale,omitempty" yaml:"scale,omitempty"`
+	Base  int64 `json:"base,omitempty" yaml:"base,omitempty"`
+
+	// piecewise
+	Pieces []Piece `json:"pieces,omitempty" yaml:"pieces,omitempty"`
+
+	// capped。Max は10進数の文字列
+	Of  *Formula `json:"of,omitempty" yaml:"of,omitempty"`
+	Max string   `json:"max,omitempty" yaml:"max,omitempty"`
+
+	// expr
+	Expr string `json:"expr,omitempty" yaml:"expr,omitempty"`
+
+	compiled exprNode // Compile で解析した Expr
+	max      *big.Int // Compile で解析した Max
+}
+
+// From 個目以降に使う式
+type Piece struct {
+	From    int64   `json:"from" yaml:"from"`
+	Formula Formula `json:"formula" yaml:"formula"`
+}
+
+// 式を検証し、Expr と Max を解析しておく
+func (f *Formula) Compile() error {
+	switch f.Type {
+	case FormulaExp4:
+		if f.A < 0 || f.B < 0 || f.C < 0 || f.D < 0 {
+			return fmt.Errorf("exp4: parameters must not be negative")
+		}
+	case FormulaPolynomial:
+		if len(f.Coefficients) == 0 {
+			return fmt.Errorf("polynomial: coefficients are required")
+		}
+	case FormulaExponential:
+		if f.Base < 0 {
+			return fmt.Errorf("exponential: base must not be negative")
+		}
+	case FormulaPiecewise:
+		if len(f.Pieces) == 0 {
+			return fmt.Errorf("piecewise: pieces are required")
+		}
+		if !sort.SliceIsSorted(f.Pieces, func(i, j int) bool { return f.Pieces[i].From < f.Pieces[j].From }) {
+			return fmt.Errorf("piecewise: pieces must be sorted by from")
+		}
+		for i := range f.Pieces {
+			if 0 < i && f.Pieces[i-1].From == f.Pieces[i].From {
+				return fmt.Errorf("piecewise: duplicate from %d", f.Pieces[i].From)
+			}
+			if err := f.Pieces[i].Formula.Compile(); err != nil {
+				return fmt.Errorf("piecewise: %v", err)
+			}
+		}
+	case FormulaCapped:
+		if f.Of == nil {
+			return fmt.Errorf("capped: of is required")
+		}
+		max, ok := new(big.Int).SetString(f.Max, 10)
+		if !ok {
+			return fmt.Errorf("capped: invalid max %q", f.Max)
+		}
+		if err := f.Of.Compile(); err != nil {
+			return fmt.Errorf("capped: %v", err)
+		}
+		f.max = max
+	case FormulaExpr:
+		n, err := parseExpr(f.Expr)
+		if err != nil {
+			return fmt.Errorf("expr: %v", err)
+		}
+		f.compiled = n
+	default:
+		return fmt.Errorf("unknown formula type %q", f.Type)
+	}
+	return nil
+}
+
+// x 個目の値を計算する。Compile で検証していない式や、大きすぎて計算できない式は 0 になる
+func (f *Formula) Eval(x int64) *big.Int {
+	v, err := f.evaluate(x)
+	if err != nil {
+		return new(big.Int)
+	}
+	return v
+}
+
+// x 個目の値を計算する。値が maxFormulaBits を超えるならエラーを返す
+func (f *Formula) evaluate(x int64) (*big.Int, error) {
+	v, err := f.value(x)
+	if err != nil {
+		return nil, err
+	}
+	if maxFormulaBits < v.BitLen() {
+		return nil, errFormulaTooLarge
+	}
+	return v, nil
+}
+
+func (f *Formula) value(x int64) (*big.Int, error) {
+	switch f.Type {
+	case FormulaExp4:
+		e := new(big.Int).Mul(big.NewInt(f.A), big.NewInt(x))
+		if err := checkPow(big.NewInt(f.D), e.Add(e, big.NewInt(f.B))); err != nil {
+			return nil, err
+		}
+		return Exp4(f.A, f.B, f.C, f.D, x), nil
+	case FormulaPolynomial:
+		// Horner 法
+		result := new(big.Int)
+		bx := big.NewInt(x)
+		for i := len(f.Coefficients) - 1; 0 <= i; i-- {
+			result.Mul(result, bx)
+			result.Add(result, big.NewInt(f.Coefficients[i]))
+		}
+		return result, nil
+	case FormulaExponential:
+		if x < 0 {
+			return new(big.Int), nil
+		}
+		if err := checkPow(big.NewInt(f.Base), big.NewInt(x)); err != nil {
+			return nil, err
+		}
+		scale := f.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		t := new(big.Int).Exp(big.NewInt(f.Base), big.NewInt(x), nil)
+		return t.Mul(t, big.NewInt(scale)), nil
+	case FormulaPiecewise:
+		if len(f.Pieces) == 0 {
+			return new(big.Int), nil
+		}
+		i := sort.Search(len(f.Pieces), func(i int) bool { return x < f.Pieces[i].From })
+		if i == 0 {
+			i = 1 // 最初の From より前も最初の式を使う
+		}
+		return f.Pieces[i-1].Formula.evaluate(x)
+	case FormulaCapped:
+		if f.Of == nil {
+			return new(big.Int), nil
+		}
+		max := f.max
+		if max == nil {
+			max = Str2Big(f.Max)
+		}
+		v, err := f.Of.evaluate(x)
+		if err != nil {
+			return nil, err
+		}
+		if max.Cmp(v) < 0 {
+			v.Set(max)
+		}
+		return v, nil
+	case FormulaExpr:
+		n := f.compiled
+		if n == nil {
+			var err error
+			n, err = parseExpr(f.Expr)
+			if err != nil {
+				return new(big.Int), nil
+			}
+		}
+		return n.eval(big.NewInt(x))
+	}
+	return new(big.Int), nil
+}
+
+// base^exp (exp >= 0) が maxFormulaBits を超えるならエラーを返す
+func checkPow(base, exp *big.Int) error {
+	// |base| が 2 以上なら結果は少なくとも (base のビット数 - 1) * exp ビットある
+	if 1 < base.BitLen() && (!exp.IsInt64() || maxFormulaBits/int64(base.BitLen()-1) < exp.Int64()) {
+		return errFormulaTooLarge
+	}
+	return nil
+}
+
+// m_item の power_formula, price_formula 列の JSON を読む
+func (f *Formula) Scan(src interface{}) error {
+	var b []byte
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Formula", src)
+	}
+	return json.Unmarshal(b, f)
+}
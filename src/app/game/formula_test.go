@@ -0,0 +1,112 @@
+package game
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormula(t *testing.T) {
+	assert := assert.New(t)
+
+	eval := func(s string, x int64) string {
+		var f Formula
+		assert.Nil(json.Unmarshal([]byte(s), &f))
+		assert.Nil(f.Compile(), s)
+		return f.Eval(x).String()
+	}
+
+	assert.Equal(Exp4(1, 2, 2, 3, 4).String(), eval(`{"type": "exp4", "a": 1, "b": 2, "c": 2, "d": 3}`, 4))
+	assert.Equal("57", eval(`{"type": "polynomial", "coefficients": [7, 0, 2]}`, 5))
+	assert.Equal("1", eval(`{"type": "exponential", "base": 10}`, 0))
+	assert.Equal("3000000000000000000000", eval(`{"type": "exponential", "scale": 3, "base": 10}`, 21))
+
+	piecewise := `{"type": "piecewise", "pieces": [
+		{"from": 0, "formula": {"type": "polynomial", "coefficients": [1]}},
+		{"from": 10, "formula": {"type": "polynomial", "coefficients": [0, 2]}}
+	]}`
+	assert.Equal("1", eval(piecewise, 9))
+	assert.Equal("20", eval(piecewise, 10))
+	assert.Equal("200", eval(piecewise, 100))
+
+	capped := `{"type": "capped", "max": "1000", "of": {"type": "exponential", "base": 2}}`
+	assert.Equal("512", eval(capped, 9))
+	assert.Equal("1000", eval(capped, 10))
+
+	assert.Equal("243", eval(`{"type": "expr", "expr": "3^x"}`, 5))
+	assert.Equal("14", eval(`{"type": "expr", "expr": "2 + 3 * 4"}`, 0))
+	assert.Equal("20", eval(`{"type": "expr", "expr": "(2 + 3) * 4"}`, 0))
+	assert.Equal("512", eval(`{"type": "expr", "expr": "2^3^2"}`, 0))
+	assert.Equal("-6", eval(`{"type": "expr", "expr": "-x * 2"}`, 3))
+	assert.Equal("2", eval(`{"type": "expr", "expr": "(x+1) % 3"}`, 4))
+	assert.Equal("0", eval(`{"type": "expr", "expr": "x / (x - 4)"}`, 4))
+	assert.Equal("0", eval(`{"type": "expr", "expr": "2 ^ (0 - x)"}`, 4))
+	assert.Equal("123456789012345678901234567890", eval(`{"type": "expr", "expr": "123456789012345678901234567890"}`, 0))
+
+	for _, s := range []string{
+		`{"type": "unknown"}`,
+		`{"type": "exp4", "a": -1}`,
+		`{"type": "polynomial"}`,
+		`{"type": "piecewise", "pieces": [{"from": 10, "formula": {"type": "expr", "expr": "x"}}, {"from": 0, "formula": {"type": "expr", "expr": "x"}}]}`,
+		`{"type": "capped", "max": "abc", "of": {"type": "expr", "expr": "x"}}`,
+		`{"type": "expr", "expr": "x +"}`,
+		`{"type": "expr", "expr": "(x"}`,
+		`{"type": "expr", "expr": "y"}`,
+	} {
+		var f Formula
+		assert.Nil(json.Unmarshal([]byte(s), &f))
+		assert.NotNil(f.Compile(), s)
+	}
+}
+
+func TestItemFormula(t *testing.T) {
+	assert := assert.New(t)
+
+	x := MItem{
+		ItemID:       1,
+		PowerFormula: &Formula{Type: FormulaExpr, Expr: "x * 10"},
+		PriceFormula: &Formula{Type: FormulaPolynomial, Coefficients: []int64{1, 1}},
+	}
+	assert.Equal(0, x.GetPower(3).Cmp(big.NewInt(30)))
+	assert.Equal(0, x.GetPrice(3).Cmp(big.NewInt(4)))
+
+	mItems, err := NewItems([]MItem{x})
+	assert.Nil(err)
+	item := mItems[1]
+	assert.Equal(0, item.GetPower(bufferNum+1).Cmp(big.NewInt(10*(bufferNum+1))))
+	assert.Equal(0, item.GetPrice(3).Cmp(big.NewInt(4)))
+
+	// 価格が 0 以下になる式は読み込めない。バッファより先も validatedOrdinals 個目まで確かめる
+	x.PriceFormula = &Formula{Type: FormulaExpr, Expr: "10 - x"}
+	_, err = NewItems([]MItem{x})
+	assert.NotNil(err)
+	x.PriceFormula = &Formula{Type: FormulaExpr, Expr: "1001 - x"}
+	_, err = NewItems([]MItem{x})
+	assert.NotNil(err)
+
+	// 大きすぎる値になる式は計算を打ち切って読み込めない
+	for _, expr := range []string{"x^x^x", "9^9^9^9", "2^x^3", "(2^60000) * (2^60000)"} {
+		x.PriceFormula = &Formula{Type: FormulaExpr, Expr: expr}
+		_, err = NewItems([]MItem{x})
+		assert.NotNil(err, expr)
+	}
+	x.PriceFormula = &Formula{Type: FormulaExp4, A: 1 << 40, B: 0, C: 0, D: 2}
+	_, err = NewItems([]MItem{x})
+	assert.NotNil(err)
+	x.PriceFormula = &Formula{Type: FormulaExpr, Expr: "(0-1)^(2^60000) + 2^x"}
+	_, err = NewItems([]MItem{x})
+	assert.Nil(err)
+
+	// power1..price4 で書いたアイテムも、大きすぎる値になるものは計算せずに読み込めない
+	y := MItem{ItemID: 1, Power1: 1 << 40, Power2: 0, Power3: 0, Power4: 2, Price1: 0, Price2: 1, Price3: 0, Price4: 1}
+	_, err = NewItems([]MItem{y})
+	assert.NotNil(err)
+	y.Power1, y.Price3 = 0, math.MaxInt64
+	_, err = NewItems([]MItem{y})
+	assert.NotNil(err)
+	_, err = NewItems(BuiltinItems())
+	assert.Nil(err)
+}
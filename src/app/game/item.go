@@ -0,0 +1,265 @@
+package game
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"sort"
+)
+
+// アイテムのマスタデータ。x 個目の生産力と価格は PowerFormula, PriceFormula で決まり、
+// 無ければ Power1..4, Price1..4 を Exp4 に渡した値になる
+type MItem struct {
+	ItemID int   `json:"item_id" yaml:"item_id" db:"item_id"`
+	Power1 int64 `json:"power1" yaml:"power1" db:"power1"`
+	Power2 int64 `json:"power2" yaml:"power2" db:"power2"`
+	Power3 int64 `json:"power3" yaml:"power3" db:"power3"`
+	Power4 int64 `json:"power4" yaml:"power4" db:"power4"`
+	Price1 int64 `json:"price1" yaml:"price1" db:"price1"`
+	Price2 int64 `json:"price2" yaml:"price2" db:"price2"`
+	Price3 int64 `json:"price3" yaml:"price3" db:"price3"`
+	Price4 int64 `json:"price4" yaml:"price4" db:"price4"`
+
+	PowerFormula *Formula `json:"power_formula,omitempty" yaml:"power_formula,omitempty" db:"power_formula"`
+	PriceFormula *Formula `json:"price_formula,omitempty" yaml:"price_formula,omitempty" db:"price_formula"`
+
+	buffer *itemBuffer // NewItems で作ったときだけ持つ
+}
+
+var itemLists []MItem = []MItem{
+	// ItemID:0は存在しないアイテムID
+	MItem{ItemID: 0, Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 1, Price4: 1},
+	MItem{ItemID: 1, Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 1, Price4: 1},
+	MItem{ItemID: 2, Power1: 0, Power2: 1, Power3: 1, Power4: 1, Price1: 0, Price2: 1, Price3: 2, Price4: 1},
+	MItem{ItemID: 3, Power1: 1, Power2: 10, Power3: 0, Power4: 2, Price1: 1, Price2: 3, Price3: 1, Price4: 2},
+	MItem{ItemID: 4, Power1: 1, Power2: 24, Power3: 1, Power4: 2, Price1: 1, Price2: 10, Price3: 0, Price4: 3},
+	MItem{ItemID: 5, Power1: 1, Power2: 25, Power3: 100, Power4: 3, Price1: 2, Price2: 20, Price3: 20, Price4: 2},
+	MItem{ItemID: 6, Power1: 1, Power2: 30, Power3: 147, Power4: 13, Price1: 1, Price2: 22, Price3: 69, Price4: 17},
+	MItem{ItemID: 7, Power1: 5, Power2: 80, Power3: 128, Power4: 6, Price1: 6, Price2: 61, Price3: 200, Price4: 5},
+	MItem{ItemID: 8, Power1: 20, Power2: 340, Power3: 180, Power4: 3, Price1: 9, Price2: 105, Price3: 134, Price4: 14},
+	MItem{ItemID: 9, Power1: 55, Power2: 520, Power3: 335, Power4: 5, Price1: 48, Price2: 243, Price3: 600, Price4: 7},
+	MItem{ItemID: 10, Power1: 157, Power2: 1071, Power3: 1700, Power4: 12, Price1: 157, Price2: 625, Price3: 1000, Price4: 13},
+	MItem{ItemID: 11, Power1: 2000, Power2: 7500, Power3: 2600, Power4: 3, Price1: 2001, Price2: 5430, Price3: 1000, Price4: 3},
+	MItem{ItemID: 12, Power1: 1000, Power2: 9000, Power3: 0, Power4: 17, Price1: 963, Price2: 7689, Price3: 1, Price4: 19},
+	MItem{ItemID: 13, Power1: 11000, Power2: 11000, Power3: 11000, Power4: 23, Price1: 10000, Price2: 2, Price3: 2, Price4: 29},
+}
+
+// ゲームで使うアイテムの ItemID => MItem. ItemID:0 は含まない
+func DefaultItems() map[int]MItem {
+	result, err := NewItems(BuiltinItems())
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// 組み込みのアイテムの一覧。ItemID:0 は含まない
+func BuiltinItems() []MItem {
+	return append([]MItem{}, itemLists[1:]...)
+}
+
+// 読み込むときに生産力と価格を検証する個数。買える個数に上限は無い
+const validatedOrdinals = 1001
+
+// 組み込みの Exp4 のパラメータでも 1001 個目は 5000 万ビットほどになるので、
+// 式とは別に、パラメータで書いたアイテムの値が超えてはいけないビット数を決めておく
+const maxExp4Bits = 1 << 27
+
+// DefaultMemoSize でメモする NewItemsWithMemo
+func NewItems(items []MItem) (map[int]MItem, error) {
+	return NewItemsWithMemo(items, MemoConfig{Size: DefaultMemoSize})
+}
+
+// アイテムを検証して ItemID => MItem を作る。生産力と価格は validatedOrdinals 個目まで確かめる。
+// 返す MItem は最初の bufferNum 個分の生産力と価格を計算済みで持ち、
+// それ以降は使うたびに memo.Size 個までメモする
+func NewItemsWithMemo(items []MItem, memo MemoConfig) (map[int]MItem, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no items")
+	}
+	result := make(map[int]MItem, len(items))
+	for _, item := range items {
+		if err := item.Validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := result[item.ItemID]; ok {
+			return nil, fmt.Errorf("duplicate item_id %d", item.ItemID)
+		}
+		if err := item.validateOrdinals(); err != nil {
+			return nil, err
+		}
+		item.buffer = newItemBuffer(item, memo)
+		result[item.ItemID] = item
+	}
+	return result, nil
+}
+
+// 式と Exp4 のパラメータを確かめる
+func (item MItem) Validate() error {
+	if item.ItemID <= 0 {
+		return fmt.Errorf("item_id must be positive: %d", item.ItemID)
+	}
+	if item.PowerFormula != nil {
+		if err := item.PowerFormula.Compile(); err != nil {
+			return fmt.Errorf("item %d: power_formula: %v", item.ItemID, err)
+		}
+	} else if item.Power1 < 0 || item.Power2 < 0 || item.Power3 < 0 || item.Power4 < 0 {
+		return fmt.Errorf("item %d: power parameters must not be negative", item.ItemID)
+	}
+	if item.PriceFormula != nil {
+		if err := item.PriceFormula.Compile(); err != nil {
+			return fmt.Errorf("item %d: price_formula: %v", item.ItemID, err)
+		}
+	} else if item.Price1 < 0 || item.Price2 < 0 || item.Price3 < 0 || item.Price4 <= 0 {
+		return fmt.Errorf("item %d: price parameters must not be negative and price4 must be positive", item.ItemID)
+	}
+	return nil
+}
+
+// 式によっては負の値や大きすぎる値になりうるので、validatedOrdinals 個目まで全て計算する。
+// パラメータで書いたものは負にならず x について増えるので、validatedOrdinals 個目の大きさだけ見積もる
+func (item MItem) validateOrdinals() error {
+	if item.PowerFormula == nil {
+		if err := checkExp4(item.Power1, item.Power2, item.Power3, item.Power4, validatedOrdinals); err != nil {
+			return fmt.Errorf("item %d: power parameters: %v", item.ItemID, err)
+		}
+	}
+	if item.PriceFormula == nil {
+		if err := checkExp4(item.Price1, item.Price2, item.Price3, item.Price4, validatedOrdinals); err != nil {
+			return fmt.Errorf("item %d: price parameters: %v", item.ItemID, err)
+		}
+	}
+	if item.PowerFormula == nil && item.PriceFormula == nil {
+		return nil
+	}
+	for x := int64(1); x <= validatedOrdinals; x++ {
+		if item.PowerFormula != nil {
+			v, err := item.PowerFormula.evaluate(x)
+			if err != nil {
+				return fmt.Errorf("item %d: power_formula: %v (x = %d)", item.ItemID, err, x)
+			}
+			if v.Sign() < 0 {
+				return fmt.Errorf("item %d: power must not be negative (x = %d)", item.ItemID, x)
+			}
+		}
+		if item.PriceFormula != nil {
+			v, err := item.PriceFormula.evaluate(x)
+			if err != nil {
+				return fmt.Errorf("item %d: price_formula: %v (x = %d)", item.ItemID, err, x)
+			}
+			if v.Sign() <= 0 {
+				return fmt.Errorf("item %d: price must be positive (x = %d)", item.ItemID, x)
+			}
+		}
+	}
+	return nil
+}
+
+// ItemID を昇順に並べる
+func SortedItemIDs(mItems map[int]MItem) []int {
+	ids := make([]int, 0, len(mItems))
+	for id := range mItems {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// 負でないパラメータの Exp4(a, b, c, d, x) が maxExp4Bits を超えるならエラーを返す。
+// 値は計算せず、d^(a*x+b) を (d のビット数) * (a*x+b) ビットで上から見積もる
+func checkExp4(a, b, c, d, x int64) error {
+	if c != 0 && (math.MaxInt64-1)/c < x {
+		return errExp4TooLarge
+	}
+	n := new(big.Int)
+	if 1 < d {
+		n.Mul(big.NewInt(a), big.NewInt(x))
+		n.Add(n, big.NewInt(b))
+		n.Mul(n, big.NewInt(int64(bits.Len64(uint64(d)))))
+	}
+	n.Add(n, big.NewInt(int64(bits.Len64(uint64(c*x+1)))))
+	if big.NewInt(maxExp4Bits).Cmp(n) < 0 {
+		return errExp4TooLarge
+	}
+	return nil
+}
+
+var errExp4TooLarge = fmt.Errorf("value exceeds %d bits", maxExp4Bits)
+
+// (c*x+1) * d^(a*x+b)
+func Exp4(a, b, c, d, x int64) *big.Int {
+	s := big.NewInt(c*x + 1)
+	t := new(big.Int).Exp(big.NewInt(d), big.NewInt(a*x+b), nil)
+	return new(big.Int).Mul(s, t)
+}
+
+const bufferNum = 50
+
+// 最初の bufferNum 個分の生産力と価格と、それ以降のメモ。
+// バッファは作った後は書き換えない
+type itemBuffer struct {
+	powerBuffer []*big.Int
+	priceBuffer []*big.Int
+
+	powerMemo *memo
+	priceMemo *memo
+	stats     *MemoStats
+}
+
+func newItemBuffer(item MItem, memo MemoConfig) *itemBuffer {
+	b := &itemBuffer{
+		powerBuffer: make([]*big.Int, bufferNum),
+		priceBuffer: make([]*big.Int, bufferNum),
+		powerMemo:   newMemo(memo.Size),
+		priceMemo:   newMemo(memo.Size),
+		stats:       memo.Stats,
+	}
+	for j := 0; j < bufferNum; j++ {
+		b.powerBuffer[j] = item.power(j)
+		b.priceBuffer[j] = item.price(j)
+	}
+	return b
+}
+
+func (item *MItem) buffered(count int) bool {
+	return item.buffer != nil && 0 <= count && count < bufferNum
+}
+
+// 返す値は共有しているので書き換えてはいけない
+func (item *MItem) GetPower(count int) *big.Int {
+	if item.buffer == nil {
+		return item.power(count)
+	}
+	if item.buffered(count) {
+		item.buffer.stats.hit()
+		return item.buffer.powerBuffer[count]
+	}
+	return item.buffer.powerMemo.get(count, item.buffer.stats, item.power)
+}
+
+// 返す値は共有しているので書き換えてはいけない
+func (item *MItem) GetPrice(count int) *big.Int {
+	if item.buffer == nil {
+		return item.price(count)
+	}
+	if item.buffered(count) {
+		item.buffer.stats.hit()
+		return item.buffer.priceBuffer[count]
+	}
+	return item.buffer.priceMemo.get(count, item.buffer.stats, item.price)
+}
+
+func (item *MItem) power(count int) *big.Int {
+	if item.PowerFormula != nil {
+		return item.PowerFormula.Eval(int64(count))
+	}
+	return Exp4(item.Power1, item.Power2, item.Power3, item.Power4, int64(count))
+}
+
+func (item *MItem) price(count int) *big.Int {
+	if item.PriceFormula != nil {
+		return item.PriceFormula.Eval(int64(count))
+	}
+	return Exp4(item.Price1, item.Price2, item.Price3, item.Price4, int64(count))
+}
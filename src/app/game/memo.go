@@ -0,0 +1,112 @@
+package game
+
+import (
+	"container/list"
+	"math/big"
+	"sync"
+	"sync/atomic"
+)
+
+// 1 アイテムの生産力か価格ごとに覚えておく既定の個数
+const DefaultMemoSize = 1024
+
+// bufferNum 個目以降の生産力と価格を覚えておく設定
+type MemoConfig struct {
+	Size  int        // 1 アイテムの生産力か価格ごとに覚えておく最大の個数。0 なら覚えない
+	Stats *MemoStats // nil なら数えない
+}
+
+// バッファかメモにあった回数と、計算し直した回数
+type MemoStats struct {
+	hits   uint64
+	misses uint64
+}
+
+func (s *MemoStats) Hits() uint64 {
+	return atomic.LoadUint64(&s.hits)
+}
+
+func (s *MemoStats) Misses() uint64 {
+	return atomic.LoadUint64(&s.misses)
+}
+
+func (s *MemoStats) hit() {
+	if s != nil {
+		atomic.AddUint64(&s.hits, 1)
+	}
+}
+
+func (s *MemoStats) miss() {
+	if s != nil {
+		atomic.AddUint64(&s.misses, 1)
+	}
+}
+
+// 最近使った順に size 個まで覚えておく count => 値
+type memo struct {
+	size int
+
+	mu sync.Mutex
+	ll *list.List // 先頭ほど最近使った memoEntry
+	m  map[int]*list.Element
+}
+
+type memoEntry struct {
+	count int
+	value *big.Int
+}
+
+func newMemo(size int) *memo {
+	return &memo{size: size, ll: list.New(), m: map[int]*list.Element{}}
+}
+
+// 覚えていればその値を、無ければ compute で計算して覚えた値を返す
+func (m *memo) get(count int, stats *MemoStats, compute func(int) *big.Int) *big.Int {
+	if m.size <= 0 {
+		stats.miss()
+		return compute(count)
+	}
+
+	m.mu.Lock()
+	if e, ok := m.m[count]; ok {
+		m.ll.MoveToFront(e)
+		m.mu.Unlock()
+		stats.hit()
+		return e.Value.(*memoEntry).value
+	}
+	m.mu.Unlock()
+
+	// 計算に時間がかかることがあるのでロックの外で計算する
+	stats.miss()
+	v := compute(count)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.m[count]; ok {
+		return e.Value.(*memoEntry).value
+	}
+	m.m[count] = m.ll.PushFront(&memoEntry{count: count, value: v})
+	if m.size < m.ll.Len() {
+		e := m.ll.Back()
+		m.ll.Remove(e)
+		delete(m.m, e.Value.(*memoEntry).count)
+	}
+	return v
+}
+
+func (m *memo) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ll.Len()
+}
+
+// mItems が覚えている生産力と価格の数
+func MemoEntries(mItems map[int]MItem) int {
+	n := 0
+	for _, item := range mItems {
+		if item.buffer != nil {
+			n += item.buffer.powerMemo.len() + item.buffer.priceMemo.len()
+		}
+	}
+	return n
+}
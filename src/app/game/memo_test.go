@@ -0,0 +1,74 @@
+package game
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemo(t *testing.T) {
+	assert := assert.New(t)
+
+	computed := 0
+	compute := func(count int) *big.Int {
+		computed++
+		return big.NewInt(int64(count) * 10)
+	}
+	stats := &MemoStats{}
+	m := newMemo(2)
+
+	assert.Equal("10", m.get(1, stats, compute).String())
+	assert.Equal("20", m.get(2, stats, compute).String())
+	assert.Equal("10", m.get(1, stats, compute).String())
+	assert.Equal(2, computed)
+
+	// 一番使っていない 2 が追い出される
+	assert.Equal("30", m.get(3, stats, compute).String())
+	assert.Equal(2, m.len())
+	m.get(1, stats, compute)
+	assert.Equal(3, computed)
+	m.get(2, stats, compute)
+	assert.Equal(4, computed)
+
+	assert.Equal(uint64(2), stats.Hits())
+	assert.Equal(uint64(4), stats.Misses())
+
+	// Size 0 なら覚えない
+	m = newMemo(0)
+	m.get(1, nil, compute)
+	m.get(1, nil, compute)
+	assert.Equal(6, computed)
+	assert.Equal(0, m.len())
+}
+
+func TestItemMemo(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := &MemoStats{}
+	mItems, err := NewItemsWithMemo(BuiltinItems()[2:3], MemoConfig{Size: 4, Stats: stats})
+	assert.Nil(err)
+	item := mItems[3]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for count := bufferNum; count < bufferNum+4; count++ {
+				item.GetPower(count)
+				item.GetPrice(count)
+			}
+		}()
+	}
+	wg.Wait()
+
+	expected := Exp4(item.Price1, item.Price2, item.Price3, item.Price4, bufferNum+1)
+	assert.Equal(0, item.GetPrice(bufferNum+1).Cmp(expected))
+	assert.Equal(8, MemoEntries(mItems))
+	assert.Equal(uint64(8*8+1), stats.Hits()+stats.Misses())
+	assert.True(8 <= stats.Misses())
+	item.GetPower(0)
+	assert.Equal(uint64(8*8+2), stats.Hits()+stats.Misses())
+}
@@ -0,0 +1,493 @@
+package game
+
+import (
+	"math"
+	"math/big"
+	"sort"
+)
+
+// 時刻 time までの adding, buying と selling を畳み込んだ部屋の状態。
+// 新しい adding, buying, selling が来るたびに差分だけ更新するので、
+// 履歴を全て読み直さずに Status や購入可否を計算できる。
+type State struct {
+	mItems  map[int]MItem
+	itemIDs []int
+	speed   *big.Int // 生産力の倍率
+
+	time      int64            // この時刻までの変化は milliIsu に反映済み
+	milliIsu  *big.Int         // time 時点のミリ椅子。購入済みアイテムの価格は全て引いてある
+	power     *big.Int         // time 時点の総生産力に speed を掛けたもの。毎ミリ秒これだけミリ椅子が増える
+	bought    map[int]int      // ItemID => CountBought
+	built     map[int]int      // ItemID => time 時点の CountBuilt
+	itemPower map[int]*big.Int // ItemID => time 時点の Power
+
+	pending []pendingEvent // time より先に効果が出る adding, buying と selling (Time 順)
+}
+
+// time より先に効果が出る adding (isu != nil)、selling (selling != nil) か buying
+type pendingEvent struct {
+	time    int64
+	isu     *big.Int
+	buying  Buying
+	selling *Selling
+}
+
+// 部屋ごとに変えられるルール
+type Rules struct {
+	Items       map[int]MItem
+	Speed       int64    // 生産力の倍率。0 なら 1
+	StartingIsu *big.Int // 部屋を作ったときに持っている椅子。nil なら 0
+}
+
+// アイテムを mItems に限った、時刻 t の空の部屋を作る
+func NewState(mItems map[int]MItem, t int64) *State {
+	return NewStateWithRules(Rules{Items: mItems}, t)
+}
+
+// rules に従う時刻 t の部屋を作る
+func NewStateWithRules(rules Rules, t int64) *State {
+	speed := rules.Speed
+	if speed == 0 {
+		speed = 1
+	}
+	milliIsu := big.NewInt(0)
+	if rules.StartingIsu != nil {
+		milliIsu.Mul(rules.StartingIsu, big1000)
+	}
+	s := &State{
+		mItems:    rules.Items,
+		itemIDs:   SortedItemIDs(rules.Items),
+		speed:     big.NewInt(speed),
+		time:      t,
+		milliIsu:  milliIsu,
+		power:     big.NewInt(0),
+		bought:    map[int]int{},
+		built:     map[int]int{},
+		itemPower: map[int]*big.Int{},
+	}
+	for _, itemID := range s.itemIDs {
+		s.itemPower[itemID] = big.NewInt(0)
+	}
+	return s
+}
+
+// adding と buying を全て適用した時刻 t の状態を作る
+func Replay(mItems map[int]MItem, t int64, addings []Adding, buyings []Buying) *State {
+	return ReplayWithSellings(Rules{Items: mItems}, t, addings, buyings, nil)
+}
+
+// rules で、adding, buying と selling を全て適用した時刻 t の状態を作る。
+// 売ったアイテムは buying に無いので、selling の BoughtTime に買ったものとする
+func ReplayWithSellings(rules Rules, t int64, addings []Adding, buyings []Buying, sellings []Selling) *State {
+	s := NewStateWithRules(rules, t)
+	for _, a := range addings {
+		s.AddIsu(a.Time, Str2Big(a.Isu))
+	}
+	for _, b := range buyings {
+		s.Buy(b)
+	}
+	for _, sl := range sellings {
+		s.Buy(Buying{ItemID: sl.ItemID, Ordinal: sl.Ordinal, Time: sl.BoughtTime})
+	}
+	for _, sl := range sellings {
+		s.Sell(sl)
+	}
+	return s
+}
+
+// 状態の時刻
+func (s *State) Time() int64 {
+	return s.time
+}
+
+// 部屋で使えるアイテム。呼び出し側で書き換えてはいけない
+func (s *State) Items() map[int]MItem {
+	return s.mItems
+}
+
+// 購入済みの個数
+func (s *State) CountBought(itemID int) int {
+	return s.bought[itemID]
+}
+
+// 時刻 Time() の総生産力に倍率を掛けたもの
+func (s *State) TotalPower() *big.Int {
+	return new(big.Int).Set(s.power)
+}
+
+// adding は adding.time に isu を増加させる
+func (s *State) AddIsu(t int64, isu *big.Int) {
+	if t <= s.time {
+		s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(isu, big1000))
+		return
+	}
+	for i := range s.pending {
+		e := &s.pending[i]
+		if e.time == t && e.isu != nil {
+			e.isu.Add(e.isu, isu)
+			return
+		}
+	}
+	s.insertPending(pendingEvent{time: t, isu: new(big.Int).Set(isu)})
+}
+
+// buying は 即座に isu を消費し buying.time からアイテムの効果を発揮する
+func (s *State) Buy(b Buying) {
+	m := s.mItems[b.ItemID]
+	s.bought[b.ItemID]++
+	s.milliIsu.Sub(s.milliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), big1000))
+
+	if b.Time <= s.time {
+		power := s.build(b)
+		s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(power, big.NewInt(s.time-b.Time)))
+		return
+	}
+	s.insertPending(pendingEvent{time: b.Time, buying: b})
+}
+
+// アイテムの効果を発揮させ、増えた毎ミリ秒のミリ椅子を返す
+func (s *State) build(b Buying) *big.Int {
+	m := s.mItems[b.ItemID]
+	power := m.GetPower(b.Ordinal)
+	s.built[b.ItemID]++
+	s.itemPower[b.ItemID].Add(s.itemPower[b.ItemID], power)
+	rate := new(big.Int).Mul(power, s.speed)
+	s.power.Add(s.power, rate)
+	return rate
+}
+
+// selling は即座に個数を減らし、selling.time にアイテムの効果を止めて Refund 椅子を返す。
+// 売る Ordinal 個目は selling.time までに効果を発揮していなければならない
+func (s *State) Sell(sl Selling) {
+	s.bought[sl.ItemID]--
+
+	if sl.Time <= s.time {
+		rate := s.unbuild(sl)
+		s.milliIsu.Sub(s.milliIsu, new(big.Int).Mul(rate, big.NewInt(s.time-sl.Time)))
+		s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(Str2Big(sl.Refund), big1000))
+		return
+	}
+	s.insertPending(pendingEvent{time: sl.Time, selling: &sl})
+}
+
+// アイテムの効果を止め、減った毎ミリ秒のミリ椅子を返す
+func (s *State) unbuild(sl Selling) *big.Int {
+	m := s.mItems[sl.ItemID]
+	power := m.GetPower(sl.Ordinal)
+	s.built[sl.ItemID]--
+	s.itemPower[sl.ItemID].Sub(s.itemPower[sl.ItemID], power)
+	rate := new(big.Int).Mul(power, s.speed)
+	s.power.Sub(s.power, rate)
+	return rate
+}
+
+// アイテムの ordinal 個目が効果を発揮する時刻。既に発揮しているなら Time() を返す
+func (s *State) BuildTime(itemID, ordinal int) int64 {
+	for i := len(s.pending) - 1; 0 <= i; i-- {
+		e := s.pending[i]
+		if e.isu == nil && e.selling == nil && e.buying.ItemID == itemID && e.buying.Ordinal == ordinal {
+			return e.time
+		}
+	}
+	return s.time
+}
+
+func (s *State) insertPending(e pendingEvent) {
+	i := sort.Search(len(s.pending), func(i int) bool { return s.pending[i].time > e.time })
+	s.pending = append(s.pending, pendingEvent{})
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = e
+}
+
+// 時刻 t まで状態を進める。t が過去なら何もしない
+func (s *State) Advance(t int64) {
+	if t <= s.time {
+		return
+	}
+	n := 0
+	for ; n < len(s.pending) && s.pending[n].time <= t; n++ {
+		e := s.pending[n]
+		s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(s.power, big.NewInt(e.time-s.time)))
+		s.time = e.time
+		switch {
+		case e.isu != nil:
+			s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(e.isu, big1000))
+		case e.selling != nil:
+			s.unbuild(*e.selling)
+			s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(Str2Big(e.selling.Refund), big1000))
+		default:
+			s.build(e.buying)
+		}
+	}
+	s.pending = s.pending[n:]
+	s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(s.power, big.NewInt(t-s.time)))
+	s.time = t
+}
+
+// 時刻 t (>= s.time) におけるミリ椅子を状態を変えずに計算する
+func (s *State) MilliIsuAt(t int64) *big.Int {
+	milliIsu := new(big.Int).Set(s.milliIsu)
+	power := new(big.Int).Set(s.power)
+	cur := s.time
+	for _, e := range s.pending {
+		if e.time > t {
+			break
+		}
+		milliIsu.Add(milliIsu, new(big.Int).Mul(power, big.NewInt(e.time-cur)))
+		cur = e.time
+		switch {
+		case e.isu != nil:
+			milliIsu.Add(milliIsu, new(big.Int).Mul(e.isu, big1000))
+		case e.selling != nil:
+			m := s.mItems[e.selling.ItemID]
+			power.Sub(power, new(big.Int).Mul(m.GetPower(e.selling.Ordinal), s.speed))
+			milliIsu.Add(milliIsu, new(big.Int).Mul(Str2Big(e.selling.Refund), big1000))
+		default:
+			m := s.mItems[e.buying.ItemID]
+			power.Add(power, new(big.Int).Mul(m.GetPower(e.buying.Ordinal), s.speed))
+		}
+	}
+	return milliIsu.Add(milliIsu, new(big.Int).Mul(power, big.NewInt(t-cur)))
+}
+
+// 状態の時刻 s.time から horizon ミリ秒先までの Status を計算する
+func (s *State) Status(horizon int64) *Status {
+	var (
+		currentTime   = s.time
+		totalMilliIsu = new(big.Int).Set(s.milliIsu)
+		totalPower    = new(big.Int).Set(s.power)
+
+		itemPower      = map[int]*big.Int{}   // ItemID => Power
+		itemPrice      = map[int]*big.Int{}   // ItemID => Price
+		itemPricex1000 = map[int]*big.Int{}   // itemPricex1000
+		itemOnSale     = map[int]int64{}      // ItemID => OnSale
+		itemBuilt      = map[int]int{}        // ItemID => BuiltCount
+		itemBuilding   = map[int][]Building{} // ItemID => Buildings
+	)
+
+	for _, itemID := range s.itemIDs {
+		m := s.mItems[itemID]
+		itemPower[itemID] = new(big.Int).Set(s.itemPower[itemID])
+		itemBuilt[itemID] = s.built[itemID]
+		itemBuilding[itemID] = []Building{}
+		price := m.GetPrice(s.bought[itemID] + 1)
+		itemPrice[itemID] = price
+		itemPricex1000[itemID] = new(big.Int).Mul(price, big1000)
+		if 0 <= totalMilliIsu.Cmp(itemPricex1000[itemID]) {
+			itemOnSale[itemID] = 0 // 0 は 時刻 currentTime で購入可能であることを表す
+		}
+	}
+
+	schedule := []Schedule{
+		Schedule{
+			Time:       currentTime,
+			MilliIsu:   Big2Exp(totalMilliIsu),
+			TotalPower: Big2Exp(totalPower),
+		},
+	}
+
+	// currentTime から horizon ミリ秒先までを adding, buying と selling の時刻で区切って計算する。
+	// 区間の中では totalMilliIsu が毎ミリ秒 totalPower ずつ増えるだけなので、
+	// 購入可能になる時刻は割り算で求まる
+	end := currentTime + horizon
+	cur := currentTime
+	next := 0
+	for {
+		segEnd := end // 次の adding, buying, selling の直前まで
+		if next < len(s.pending) && s.pending[next].time <= end {
+			segEnd = s.pending[next].time - 1
+		}
+		for _, itemID := range s.itemIDs {
+			if _, ok := itemOnSale[itemID]; ok {
+				continue
+			}
+			if t, ok := reachTime(totalMilliIsu, totalPower, cur, itemPricex1000[itemID]); ok && t <= segEnd {
+				itemOnSale[itemID] = t
+			}
+		}
+		if segEnd == end {
+			break
+		}
+
+		t := segEnd + 1
+		totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(totalPower, big.NewInt(t-cur)))
+		cur = t
+
+		// 時刻 t で発生する adding, buying と selling を計算する
+		for ; next < len(s.pending) && s.pending[next].time == t; next++ {
+			e := s.pending[next]
+			if e.isu != nil {
+				totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(e.isu, big1000))
+				continue
+			}
+
+			var id int
+			if e.selling != nil {
+				// 売ったアイテムは効果が無くなり、Building には減った後の個数を載せる
+				id = e.selling.ItemID
+				m := s.mItems[id]
+				power := m.GetPower(e.selling.Ordinal)
+				itemBuilt[id]--
+				itemPower[id].Sub(itemPower[id], power)
+				totalPower.Sub(totalPower, new(big.Int).Mul(power, s.speed))
+				totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(Str2Big(e.selling.Refund), big1000))
+			} else {
+				id = e.buying.ItemID
+				m := s.mItems[id]
+				power := m.GetPower(e.buying.Ordinal)
+				itemBuilt[id]++
+				itemPower[id].Add(itemPower[id], power)
+				totalPower.Add(totalPower, new(big.Int).Mul(power, s.speed))
+			}
+			itemBuilding[id] = append(itemBuilding[id], Building{
+				Time:       t,
+				CountBuilt: itemBuilt[id],
+				Power:      Big2Exp(itemPower[id]),
+			})
+		}
+
+		schedule = append(schedule, Schedule{
+			Time:       t,
+			MilliIsu:   Big2Exp(totalMilliIsu),
+			TotalPower: Big2Exp(totalPower),
+		})
+
+		// 時刻 t で購入可能になったアイテムを記録する
+		for _, itemID := range s.itemIDs {
+			if _, ok := itemOnSale[itemID]; ok {
+				continue
+			}
+			if 0 <= totalMilliIsu.Cmp(itemPricex1000[itemID]) {
+				itemOnSale[itemID] = t
+			}
+		}
+	}
+
+	gsAdding := []Adding{}
+	for _, e := range s.pending {
+		if e.isu != nil {
+			gsAdding = append(gsAdding, Adding{Time: e.time, Isu: e.isu.String()})
+		}
+	}
+
+	gsItems := []Item{}
+	for _, itemID := range s.itemIDs {
+		gsItems = append(gsItems, Item{
+			ItemID:      itemID,
+			CountBought: s.bought[itemID],
+			CountBuilt:  s.built[itemID],
+			NextPrice:   Big2Exp(itemPrice[itemID]),
+			Power:       Big2Exp(s.itemPower[itemID]),
+			Building:    itemBuilding[itemID],
+		})
+	}
+
+	gsOnSale := []OnSale{}
+	for _, itemID := range s.itemIDs {
+		if t, ok := itemOnSale[itemID]; ok {
+			gsOnSale = append(gsOnSale, OnSale{
+				ItemID: itemID,
+				Time:   t,
+			})
+		}
+	}
+
+	return &Status{
+		Adding:   gsAdding,
+		Schedule: schedule,
+		Items:    gsItems,
+		OnSale:   gsOnSale,
+	}
+}
+
+// 時刻 cur にミリ椅子が milliIsu で、その後毎ミリ秒 power ずつ増えるとき、
+// need 以上になる最初の時刻 (> cur) を返す。power が 0 なら届かない
+func reachTime(milliIsu, power *big.Int, cur int64, need *big.Int) (int64, bool) {
+	if power.Sign() <= 0 {
+		return 0, false
+	}
+	// ceil((need - milliIsu) / power) ミリ秒後
+	d := new(big.Int).Sub(need, milliIsu)
+	if d.Sign() <= 0 {
+		return cur + 1, true
+	}
+	q, r := new(big.Int).QuoRem(d, power, new(big.Int))
+	if r.Sign() > 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if !q.IsInt64() || q.Int64() > math.MaxInt64-cur {
+		return 0, false
+	}
+	return cur + q.Int64(), true
+}
+
+// JSON で保存できる State
+type Snapshot struct {
+	Time      int64          `json:"time"`
+	MilliIsu  string         `json:"milli_isu"`
+	Bought    map[int]int    `json:"bought"`
+	Built     map[int]int    `json:"built"`
+	ItemPower map[int]string `json:"item_power"`
+	Adding    []Adding       `json:"adding"`
+	Buying    []Buying       `json:"buying"`
+	Selling   []Selling      `json:"selling,omitempty"`
+}
+
+func (s *State) Snapshot() Snapshot {
+	x := Snapshot{
+		Time:      s.time,
+		MilliIsu:  s.milliIsu.String(),
+		Bought:    map[int]int{},
+		Built:     map[int]int{},
+		ItemPower: map[int]string{},
+		Adding:    []Adding{},
+		Buying:    []Buying{},
+	}
+	for itemID, n := range s.bought {
+		x.Bought[itemID] = n
+	}
+	for itemID, n := range s.built {
+		x.Built[itemID] = n
+	}
+	for itemID, power := range s.itemPower {
+		x.ItemPower[itemID] = power.String()
+	}
+	for _, e := range s.pending {
+		switch {
+		case e.isu != nil:
+			x.Adding = append(x.Adding, Adding{Time: e.time, Isu: e.isu.String()})
+		case e.selling != nil:
+			x.Selling = append(x.Selling, *e.selling)
+		default:
+			x.Buying = append(x.Buying, e.buying)
+		}
+	}
+	return x
+}
+
+// rules に従う部屋の Snapshot から State を作り直す
+func Restore(rules Rules, x Snapshot) *State {
+	s := NewStateWithRules(rules, x.Time)
+	s.milliIsu = Str2Big(x.MilliIsu)
+	for itemID, n := range x.Bought {
+		s.bought[itemID] = n
+	}
+	for itemID, n := range x.Built {
+		s.built[itemID] = n
+	}
+	for itemID, power := range x.ItemPower {
+		s.itemPower[itemID] = Str2Big(power)
+		s.power.Add(s.power, new(big.Int).Mul(s.itemPower[itemID], s.speed))
+	}
+	for _, a := range x.Adding {
+		s.insertPending(pendingEvent{time: a.Time, isu: Str2Big(a.Isu)})
+	}
+	for _, b := range x.Buying {
+		s.insertPending(pendingEvent{time: b.Time, buying: b})
+	}
+	for _, sl := range x.Selling {
+		sl := sl
+		s.insertPending(pendingEvent{time: sl.Time, selling: &sl})
+	}
+	return s
+}
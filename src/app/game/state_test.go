@@ -0,0 +1,227 @@
+package game
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// バッファを作るのに時間がかかるので使い回す
+var defaultItems = DefaultItems()
+
+// 差分更新した状態と全て読み直した状態が一致する
+func TestRoomStateIncremental(t *testing.T) {
+	assert := assert.New(t)
+
+	x := MItem{
+		ItemID: 1,
+		Power1: 0, Power2: 1, Power3: 0, Power4: 10,
+		Price1: 0, Price2: 1, Price3: 0, Price4: 10,
+	}
+	y := MItem{
+		ItemID: 2,
+		Power1: 1, Power2: 1, Power3: 3, Power4: 2,
+		Price1: 1, Price2: 1, Price3: 7, Price4: 6,
+	}
+	mItems := map[int]MItem{1: x, 2: y}
+	addings := []Adding{
+		Adding{Time: 0, Isu: "100000"},
+		Adding{Time: 1500, Isu: "7"},
+		Adding{Time: 1500, Isu: "3"},
+		Adding{Time: 2600, Isu: "5"},
+	}
+	buyings := []Buying{
+		Buying{ItemID: 1, Ordinal: 1, Time: 100},
+		Buying{ItemID: 2, Ordinal: 1, Time: 1200},
+		Buying{ItemID: 1, Ordinal: 2, Time: 2500},
+	}
+
+	s := NewState(mItems, 0)
+	s.AddIsu(addings[0].Time, Str2Big(addings[0].Isu))
+	s.Buy(buyings[0])
+	s.Advance(1000)
+	s.Buy(buyings[1])
+	s.AddIsu(addings[1].Time, Str2Big(addings[1].Isu))
+	s.AddIsu(addings[2].Time, Str2Big(addings[2].Isu))
+	s.Advance(2000)
+	s.Buy(buyings[2])
+	s.AddIsu(addings[3].Time, Str2Big(addings[3].Isu))
+
+	assert.Equal(0, s.MilliIsuAt(3000).Cmp(Replay(mItems, 3000, addings, buyings).milliIsu))
+
+	s.Advance(2100)
+	expected, err := CalcStatus(2100, mItems, addings, buyings)
+	assert.Nil(err)
+	assert.Equal(expected, s.Status(DefaultHorizon))
+
+	s.Advance(3000)
+	expected, err = CalcStatus(3000, mItems, addings, buyings)
+	assert.Nil(err)
+	assert.Equal(expected, s.Status(DefaultHorizon))
+	assert.Equal(0, s.power.Cmp(new(big.Int).Add(new(big.Int).Add(x.GetPower(1), x.GetPower(2)), y.GetPower(1))))
+
+	// ルールの倍率と最初の椅子も使う
+	rules := Rules{Items: mItems, Speed: 3, StartingIsu: big.NewInt(100)}
+	r := NewStateWithRules(rules, 0)
+	for _, a := range addings {
+		r.AddIsu(a.Time, Str2Big(a.Isu))
+	}
+	for _, b := range buyings {
+		r.Buy(b)
+	}
+	assert.Equal(0, r.MilliIsuAt(3000).Cmp(ReplayWithSellings(rules, 3000, addings, buyings, nil).milliIsu))
+	assert.NotEqual(0, r.MilliIsuAt(3000).Cmp(s.MilliIsuAt(3000)))
+}
+
+// 1ミリ秒ずつ進めて購入可能になる時刻を求める
+func simulateOnSale(s *State, horizon int64) map[int]int64 {
+	milliIsu := new(big.Int).Set(s.milliIsu)
+	power := new(big.Int).Set(s.power)
+	onSale := map[int]int64{}
+	check := func(t int64) {
+		for _, itemID := range s.itemIDs {
+			if _, ok := onSale[itemID]; ok {
+				continue
+			}
+			m := s.mItems[itemID]
+			need := new(big.Int).Mul(m.GetPrice(s.bought[itemID]+1), big1000)
+			if milliIsu.Cmp(need) >= 0 {
+				onSale[itemID] = t
+			}
+		}
+	}
+	check(0)
+	for t := s.time + 1; t <= s.time+horizon; t++ {
+		milliIsu.Add(milliIsu, power)
+		for _, e := range s.pending {
+			if e.time != t {
+				continue
+			}
+			if e.isu != nil {
+				milliIsu.Add(milliIsu, new(big.Int).Mul(e.isu, big1000))
+			} else {
+				m := s.mItems[e.buying.ItemID]
+				power.Add(power, m.GetPower(e.buying.Ordinal))
+			}
+		}
+		check(t)
+	}
+	return onSale
+}
+
+func TestOnSaleMatchesSimulation(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewState(defaultItems, 0)
+	s.AddIsu(0, big.NewInt(3))
+	s.Buy(Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	s.AddIsu(123, big.NewInt(1))
+	s.Buy(Buying{ItemID: 2, Ordinal: 1, Time: 300})
+	s.AddIsu(300, big.NewInt(40))
+	s.AddIsu(700, Str2Big("1000000"))
+	s.Advance(10)
+
+	status := s.Status(DefaultHorizon)
+	expected := simulateOnSale(s, 1000)
+	assert.Len(status.OnSale, len(expected))
+	for _, o := range status.OnSale {
+		assert.Equal(expected[o.ItemID], o.Time, "item %d", o.ItemID)
+	}
+}
+
+// 先読みの範囲内の adding だけが Schedule に入る
+func TestStatusWithin(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewState(defaultItems, 0)
+	s.AddIsu(0, big.NewInt(1))
+	s.Buy(Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	s.AddIsu(2500, big.NewInt(3))
+
+	for _, horizon := range []int64{2000, 3000} {
+		status := s.Status(horizon)
+		expected := simulateOnSale(s, horizon)
+		assert.Len(status.OnSale, len(expected))
+		for _, o := range status.OnSale {
+			assert.Equal(expected[o.ItemID], o.Time, "item %d", o.ItemID)
+		}
+	}
+	assert.Len(s.Status(2000).Schedule, 1)
+	assert.Len(s.Status(3000).Schedule, 2)
+}
+
+// 倍率を掛けた生産力で椅子が増え、最初の椅子から始まる
+func TestStateWithRules(t *testing.T) {
+	assert := assert.New(t)
+
+	x := MItem{
+		ItemID: 1,
+		Power1: 0, Power2: 1, Power3: 0, Power4: 10,
+		Price1: 0, Price2: 1, Price3: 0, Price4: 10,
+	}
+	mItems := map[int]MItem{1: x}
+	s := NewStateWithRules(Rules{Items: mItems, Speed: 3, StartingIsu: big.NewInt(10)}, 0)
+	assert.Equal("10000", s.MilliIsuAt(0).String())
+
+	s.Buy(Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	s.Advance(1000)
+	// 1 個目の生産力 10 を 3 倍して 1 秒分
+	assert.Equal("30000", s.MilliIsuAt(1000).String())
+	assert.Equal(Big2Exp(big.NewInt(30)), s.Status(DefaultHorizon).Schedule[0].TotalPower)
+
+	restored := Restore(Rules{Items: mItems, Speed: 3}, s.Snapshot())
+	assert.Equal(s.Status(DefaultHorizon), restored.Status(DefaultHorizon))
+}
+
+// 売ったアイテムは売った時刻から効果が無くなり、返金される
+func TestSell(t *testing.T) {
+	assert := assert.New(t)
+
+	x := MItem{
+		ItemID: 1,
+		Power1: 0, Power2: 1, Power3: 0, Power4: 10,
+		Price1: 0, Price2: 1, Price3: 0, Price4: 10,
+	}
+	mItems := map[int]MItem{1: x}
+	addings := []Adding{Adding{Time: 0, Isu: "1000"}}
+	buyings := []Buying{Buying{ItemID: 1, Ordinal: 1, Time: 100}}
+	sellings := []Selling{Selling{ItemID: 1, Ordinal: 2, BoughtTime: 200, Time: 1500, Refund: "7"}}
+
+	s := NewState(mItems, 0)
+	s.AddIsu(0, big.NewInt(1000))
+	s.Buy(buyings[0])
+	s.Buy(Buying{ItemID: 1, Ordinal: 2, Time: 200})
+	s.Advance(1000)
+	assert.Equal(int64(1000), s.BuildTime(1, 2))
+	s.Sell(sellings[0])
+	assert.Equal(1, s.CountBought(1))
+
+	status := s.Status(DefaultHorizon)
+	expected, err := CalcStatusWithSellings(1000, mItems, addings, buyings, sellings)
+	assert.Nil(err)
+	assert.Equal(expected, status)
+	assert.Equal([]Building{{Time: 1500, CountBuilt: 1, Power: Big2Exp(x.GetPower(1))}}, status.Items[0].Building)
+	assert.Equal(Big2Exp(x.GetPower(1)), status.Schedule[1].TotalPower)
+
+	restored := Restore(Rules{Items: mItems}, s.Snapshot())
+	assert.Equal(status, restored.Status(DefaultHorizon))
+
+	// 1500 までは 2 個分、それ以降は 1 個分だけ増える
+	milliIsu := new(big.Int).Mul(big.NewInt(1000+7), big1000)
+	milliIsu.Sub(milliIsu, new(big.Int).Mul(new(big.Int).Add(x.GetPrice(1), x.GetPrice(2)), big1000))
+	milliIsu.Add(milliIsu, new(big.Int).Mul(x.GetPower(1), big.NewInt(2000-100)))
+	milliIsu.Add(milliIsu, new(big.Int).Mul(x.GetPower(2), big.NewInt(1500-200)))
+	assert.Equal(milliIsu.String(), s.MilliIsuAt(2000).String())
+	s.Advance(2000)
+	assert.Equal(milliIsu.String(), s.MilliIsuAt(2000).String())
+	assert.Equal(0, s.power.Cmp(x.GetPower(1)))
+
+	// 売った後に買い直したものは、効果を発揮するまで売れない
+	s.Buy(Buying{ItemID: 1, Ordinal: 2, Time: 2500})
+	assert.Equal(int64(2500), s.BuildTime(1, 2))
+	assert.Equal(int64(2000), s.BuildTime(1, 1))
+	expected, err = CalcStatusWithSellings(2000, mItems, addings, append(buyings, Buying{ItemID: 1, Ordinal: 2, Time: 2500}), sellings)
+	assert.Nil(err)
+	assert.Equal(expected, s.Status(DefaultHorizon))
+}
@@ -0,0 +1,78 @@
+// Package game は椅子ゲームのルールを計算する。
+// DB や Redis などには触らないので、サーバー以外のツールからも使える。
+package game
+
+import "math/big"
+
+var big1000 = big.NewInt(1000)
+
+// Status で先読みする既定のミリ秒数
+const DefaultHorizon = 1000
+
+type Adding struct {
+	RoomName string `json:"-" db:"room_name"`
+	Time     int64  `json:"time" db:"time"`
+	Isu      string `json:"isu" db:"isu"`
+}
+
+type Buying struct {
+	RoomName string `db:"room_name"`
+	ItemID   int    `db:"item_id"`
+	Ordinal  int    `db:"ordinal"`
+	Time     int64  `db:"time"`
+}
+
+// 購入済みのアイテムの Ordinal 個目を Time に売り、Refund 椅子を受け取る。
+// BoughtTime は売ったアイテムを買ったときの Buying.Time
+type Selling struct {
+	RoomName   string `db:"room_name"`
+	ItemID     int    `db:"item_id"`
+	Ordinal    int    `db:"ordinal"`
+	BoughtTime int64  `db:"bought_time"`
+	Time       int64  `db:"time"`
+	Refund     string `db:"refund"`
+}
+
+type Schedule struct {
+	Time       int64       `json:"time"`
+	MilliIsu   Exponential `json:"milli_isu"`
+	TotalPower Exponential `json:"total_power"`
+}
+
+type Item struct {
+	ItemID      int         `json:"item_id"`
+	CountBought int         `json:"count_bought"`
+	CountBuilt  int         `json:"count_built"`
+	NextPrice   Exponential `json:"next_price"`
+	Power       Exponential `json:"power"`
+	Building    []Building  `json:"building"`
+}
+
+type OnSale struct {
+	ItemID int   `json:"item_id"`
+	Time   int64 `json:"time"`
+}
+
+type Building struct {
+	Time       int64       `json:"time"`
+	CountBuilt int         `json:"count_built"`
+	Power      Exponential `json:"power"`
+}
+
+type Status struct {
+	Time     int64      `json:"time"`
+	Adding   []Adding   `json:"adding"`
+	Schedule []Schedule `json:"schedule"`
+	Items    []Item     `json:"items"`
+	OnSale   []OnSale   `json:"on_sale"`
+}
+
+// adding と buying から時刻 currentTime の Status を DefaultHorizon ミリ秒先まで計算する
+func CalcStatus(currentTime int64, mItems map[int]MItem, addings []Adding, buyings []Buying) (*Status, error) {
+	return CalcStatusWithSellings(currentTime, mItems, addings, buyings, nil)
+}
+
+// CalcStatus に selling も加えたもの
+func CalcStatusWithSellings(currentTime int64, mItems map[int]MItem, addings []Adding, buyings []Buying, sellings []Selling) (*Status, error) {
+	return ReplayWithSellings(Rules{Items: mItems}, currentTime, addings, buyings, sellings).Status(DefaultHorizon), nil
+}
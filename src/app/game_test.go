@@ -1,224 +1,147 @@
 package main
 
 import (
+	"encoding/json"
+	"math"
 	"math/big"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestStatusEmpty(t *testing.T) {
+// 接続ごとに Exponential の表現を選べる
+func TestConnEncoding(t *testing.T) {
 	assert := assert.New(t)
-
-	mItems := map[int]mItem{}
-	addings := []Adding{}
-	buyings := []Buying{}
-
-	s, err := calcStatus(0, mItems, addings, buyings)
-
-	assert.Nil(err)
-	assert.Empty(s.Adding)
-	assert.Len(s.Schedule, 1)
-	assert.Empty(s.OnSale)
-
-	assert.Equal(int64(0), s.Schedule[0].Time)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].TotalPower)
-}
-
-// 椅子が増える
-func TestStatusAdd(t *testing.T) {
-	assert := assert.New(t)
-
-	mItems := map[int]mItem{}
-	addings := []Adding{
-		Adding{Time: 100, Isu: "1"},
-		Adding{Time: 200, Isu: "2"},
-		Adding{Time: 300, Isu: "1234567890123456789"},
+	useMemoryBackends()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/ws/{room_name}", wsGameHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/enc"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?encoding=hex", nil)
+	assert.NotNil(err)
+	if resp != nil {
+		assert.Equal(400, resp.StatusCode)
 	}
-	buyings := []Buying{}
-
-	s, err := calcStatus(0, mItems, addings, buyings)
-	assert.Nil(err)
-	assert.Len(s.Adding, 3)
-	assert.Len(s.Schedule, 4)
-
-	assert.Equal(int64(0), s.Schedule[0].Time)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].TotalPower)
-
-	assert.Equal(int64(100), s.Schedule[1].Time)
-	assert.Equal(Exponential{1000, 0}, s.Schedule[1].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[1].TotalPower)
-
-	assert.Equal(int64(200), s.Schedule[2].Time)
-	assert.Equal(Exponential{3000, 0}, s.Schedule[2].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[2].TotalPower)
-
-	assert.Equal(int64(300), s.Schedule[3].Time)
-	assert.Equal(Exponential{123456789012345, 7}, s.Schedule[3].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[3].TotalPower)
 
-	s, err = calcStatus(500, mItems, addings, buyings)
+	ws, _, err := websocket.DefaultDialer.Dial(url+"?encoding=scientific", nil)
 	assert.Nil(err)
-	assert.Len(s.Adding, 0)
-	assert.Len(s.Schedule, 1)
+	defer ws.Close()
 
-	assert.Equal(int64(500), s.Schedule[0].Time)
-	assert.Equal(Exponential{123456789012345, 7}, s.Schedule[0].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].TotalPower)
-}
-
-// 試しに１個買う
-func TestStatusBuySingle(t *testing.T) {
-	assert := assert.New(t)
-	x := mItem{
-		ItemID: 1,
-		Power1: 0, Power2: 1, Power3: 0, Power4: 10,
-		Price1: 0, Price2: 1, Price3: 0, Price4: 10,
+	var status struct {
+		Schedule []struct {
+			MilliIsu json.RawMessage `json:"milli_isu"`
+		} `json:"schedule"`
 	}
-	mItems := map[int]mItem{1: x}
-	initialIsu := "10"
-	addings := []Adding{
-		Adding{Time: 0, Isu: initialIsu},
+	assert.Nil(ws.ReadJSON(&status))
+	assert.Equal(`"0"`, string(status.Schedule[0].MilliIsu))
+
+	assert.Nil(ws.WriteJSON(GameRequest{RequestID: 1, Action: "setEncoding", Encoding: "array"}))
+	assert.Nil(ws.WriteJSON(GameRequest{RequestID: 2, Action: "getStatus", Horizon: 1000}))
+	for {
+		var m map[string]json.RawMessage
+		assert.Nil(ws.ReadJSON(&m))
+		if _, ok := m["request_id"]; ok {
+			if string(m["request_id"]) == "2" {
+				break
+			}
+			continue
+		}
+		assert.Nil(json.Unmarshal(m["schedule"], &status.Schedule))
 	}
-	buyings := []Buying{
-		Buying{ItemID: 1, Ordinal: 1, Time: 100},
-	}
-	s, err := calcStatus(0, mItems, addings, buyings)
-	assert.Nil(err)
-	assert.Len(s.Adding, 0)
-	assert.Len(s.Schedule, 2)
-	assert.Len(s.Items, 1)
-
-	assert.Equal(int64(0), s.Schedule[0].Time)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].MilliIsu)
-	assert.Equal(Exponential{0, 0}, s.Schedule[0].TotalPower)
-
-	assert.Equal(int64(100), s.Schedule[1].Time)
-	assert.Equal(Exponential{0, 0}, s.Schedule[1].MilliIsu)
-	assert.Equal(Exponential{10, 0}, s.Schedule[1].TotalPower)
+	assert.Equal(`[0,0]`, string(status.Schedule[0].MilliIsu))
 }
 
-// 購入時間を見ます
-func TestOnSale(t *testing.T) {
+func TestBuyItems(t *testing.T) {
 	assert := assert.New(t)
-	x := mItem{
-		ItemID: 1,
-		Power1: 0, Power2: 1, Power3: 0, Power4: 1, // power: (0x+1)*1^(0x+1)
-		Price1: 0, Price2: 1, Price3: 0, Price4: 1, // price: (0x+1)*1^(0x+1)
+	useMemoryBackends()
+
+	item := currentItems()[1]
+	price := func(from, count int) *big.Int {
+		sum := new(big.Int)
+		for i := from; i < from+count; i++ {
+			sum.Add(sum, item.GetPrice(i))
+		}
+		return sum
 	}
-	mItems := map[int]mItem{1: x}
-	addings := []Adding{Adding{Time: 0, Isu: "1"}}
-	buyings := []Buying{Buying{ItemID: 1, Ordinal: 1, Time: 0}}
-
-	s, err := calcStatus(1, mItems, addings, buyings)
-	assert.Nil(err)
-	assert.Len(s.Adding, 0)
-	assert.Len(s.Schedule, 1)
-	assert.Len(s.OnSale, 1)
-	assert.Len(s.Items, 1)
-
-	assert.Equal(int64(1), s.Schedule[0].Time)
-	assert.Equal(OnSale{ItemID: 1, Time: 1000}, s.OnSale[0])
-
-	assert.Equal(s.Items[0].CountBought, 1)
-	assert.Equal(s.Items[0].Power, Exponential{1, 0})
-	assert.Equal(s.Items[0].CountBuilt, 1)
-	assert.Equal(s.Items[0].NextPrice, Exponential{1, 0})
-}
 
-func TestStatusBuy(t *testing.T) {
-	assert := assert.New(t)
+	// 3 個分だけ持っている
+	now := getCurrentTime() + 1000
+	assert.Nil(tryAddIsu("bulk", price(1, 3), now))
+	bought, err := tryBuyItems("bulk", []BuyOrder{{ItemID: 1, CountBought: 0, Count: 4}}, false, now)
+	assert.Equal(errNotEnough, err)
+	assert.Equal(0, bought)
 
-	x := mItem{
-		ItemID: 1,
-		Power1: 1, Power2: 1, Power3: 3, Power4: 2,
-		Price1: 1, Price2: 1, Price3: 7, Price4: 6,
-	}
-	y := mItem{
-		ItemID: 2,
-		Power1: 1, Power2: 1, Power3: 7, Power4: 6,
-		Price1: 1, Price2: 1, Price3: 3, Price4: 2,
-	}
-	mItems := map[int]mItem{1: x, 2: y}
-	initialIsu := "10000000"
-	addings := []Adding{
-		Adding{Time: 0, Isu: initialIsu},
-	}
-	buyings := []Buying{
-		Buying{ItemID: 1, Ordinal: 1, Time: 100},
-		Buying{ItemID: 1, Ordinal: 2, Time: 200},
-		Buying{ItemID: 2, Ordinal: 1, Time: 300},
-		Buying{ItemID: 2, Ordinal: 2, Time: 2001},
-	}
+	bought, err = tryBuyItems("bulk", []BuyOrder{{ItemID: 1, CountBought: 0, Count: 4}}, true, now)
+	assert.Nil(err)
+	assert.Equal(3, bought)
 
-	s, err := calcStatus(0, mItems, addings, buyings)
+	r, err := lockRoomState("bulk", getCurrentTime())
+	assert.Nil(err)
+	assert.Equal(3, r.state.CountBought(1))
+	assert.Equal(0, r.state.MilliIsuAt(now).Sign())
+	r.mu.Unlock()
+	buyings, err := store.LoadBuyings("bulk")
 	assert.Nil(err)
-	assert.Len(s.Adding, 0)
-	assert.Len(s.Schedule, 4)
-	assert.Len(s.OnSale, 2)
-	assert.Len(s.Items, 2)
-
-	totalPower := big.NewInt(0)
-	milliIsu := new(big.Int).Mul(str2big(initialIsu), big.NewInt(1000))
-	milliIsu.Sub(milliIsu, new(big.Int).Mul(x.GetPrice(1), big.NewInt(1000)))
-	milliIsu.Sub(milliIsu, new(big.Int).Mul(x.GetPrice(2), big.NewInt(1000)))
-	milliIsu.Sub(milliIsu, new(big.Int).Mul(y.GetPrice(1), big.NewInt(1000)))
-	milliIsu.Sub(milliIsu, new(big.Int).Mul(y.GetPrice(2), big.NewInt(1000)))
-
-	// 0sec
-	assert.Equal(int64(0), s.Schedule[0].Time)
-	assert.Equal(big2exp(milliIsu), s.Schedule[0].MilliIsu)
-	assert.Equal(big2exp(totalPower), s.Schedule[0].TotalPower)
-
-	// 0.1sec
-	totalPower.Add(totalPower, x.GetPower(1))
-	assert.Equal(int64(100), s.Schedule[1].Time)
-	assert.Equal(big2exp(milliIsu), s.Schedule[1].MilliIsu)
-	assert.Equal(big2exp(totalPower), s.Schedule[1].TotalPower)
-
-	// 0.2sec
-	milliIsu.Add(milliIsu, new(big.Int).Mul(totalPower, big.NewInt(100)))
-	totalPower.Add(totalPower, x.GetPower(2))
-	assert.Equal(int64(200), s.Schedule[2].Time)
-	assert.Equal(big2exp(milliIsu), s.Schedule[2].MilliIsu)
-	assert.Equal(big2exp(totalPower), s.Schedule[2].TotalPower)
-
-	// 0.3sec
-	milliIsu.Add(milliIsu, new(big.Int).Mul(totalPower, big.NewInt(100)))
-	totalPower.Add(totalPower, y.GetPower(1))
-	assert.Equal(int64(300), s.Schedule[3].Time)
-	assert.Equal(big2exp(milliIsu), s.Schedule[3].MilliIsu)
-	assert.Equal(big2exp(totalPower), s.Schedule[3].TotalPower)
-
-	// OnSale
-	assert.Contains(s.OnSale, OnSale{ItemID: 1, Time: 0})
-	assert.Contains(s.OnSale, OnSale{ItemID: 2, Time: 0})
+	assert.Len(buyings, 3)
+
+	_, err = tryBuyItems("bulk", []BuyOrder{{ItemID: 1, CountBought: 0, Count: 1}}, true, now)
+	assert.Equal(errAlreadyBought, err)
+	_, err = tryBuyItems("bulk", []BuyOrder{{ItemID: 1, CountBought: 3, Count: 0}}, true, now)
+	assert.Equal(errInvalidCount, err)
+	_, err = tryBuyItems("bulk", []BuyOrder{{ItemID: 999, CountBought: 0, Count: 1}}, true, now)
+	assert.Equal(errInvalidItem, err)
+	// 合計が溢れて小さくなっても上限を超えたものとして扱う
+	_, err = tryBuyItems("bulk", []BuyOrder{{ItemID: 1, CountBought: 3, Count: math.MaxInt64}, {ItemID: 2, CountBought: 0, Count: math.MaxInt64}}, true, now)
+	assert.Equal(errInvalidCount, err)
+	_, err = tryBuyItems("bulk", []BuyOrder{{ItemID: 1, CountBought: 3, Count: maxBuyItems}, {ItemID: 2, CountBought: 0, Count: 1}}, true, now)
+	assert.Equal(errInvalidCount, err)
 }
 
-func TestMItem(t *testing.T) {
+func TestSellItem(t *testing.T) {
 	assert := assert.New(t)
+	useMemoryBackends()
 
-	item := mItem{
-		ItemID: 1,
-		Power1: 1,
-		Power2: 2,
-		Power3: 2,
-		Power4: 3,
-		Price1: 5,
-		Price2: 4,
-		Price3: 3,
-		Price4: 2,
-	}
-	assert.Equal(item.GetPower(1).Cmp(big.NewInt(81)), 0)
-	assert.Equal(item.GetPrice(1).Cmp(big.NewInt(2048)), 0)
-}
+	item := currentItems()[1]
+	now := getCurrentTime() + 1000
+	assert.Nil(tryAddIsu("sell", new(big.Int).Add(item.GetPrice(1), item.GetPrice(2)), now))
+	assert.Nil(tryBuyItem("sell", 1, 0, now))
+	assert.Nil(tryBuyItem("sell", 1, 1, now+500))
 
-func TestConv(t *testing.T) {
-	assert := assert.New(t)
+	assert.Equal(errNotBuilt, trySellItem("sell", 1, 2, now+100))
+	assert.Equal(errAlreadyBought, trySellItem("sell", 1, 1, now+500))
+	assert.Equal(errInvalidCount, trySellItem("sell", 2, 0, now+500))
+	assert.Nil(trySellItem("sell", 1, 2, now+500))
 
-	assert.Equal(Exponential{0, 0}, big2exp(str2big("0")))
-	assert.Equal(Exponential{1234, 0}, big2exp(str2big("1234")))
-	assert.Equal(Exponential{111111111111110, 5}, big2exp(str2big("11111111111111000000")))
+	r, err := lockRoomState("sell", getCurrentTime())
+	assert.Nil(err)
+	assert.Equal(1, r.state.CountBought(1))
+	refund := new(big.Int).Mul(item.GetPrice(2), big.NewInt(int64(currentConfig().SellRefund)))
+	refund.Quo(refund, big.NewInt(100))
+	milliIsu := new(big.Int).Mul(refund, big1000)
+	milliIsu.Add(milliIsu, new(big.Int).Mul(item.GetPower(1), big.NewInt(1000)))
+	assert.Equal(milliIsu.String(), r.state.MilliIsuAt(now+1000).String())
+	status := r.state.Status(1000)
+	r.mu.Unlock()
+	assert.Equal(1, status.Items[0].CountBought)
+
+	// イベントログから作り直しても同じになる
+	roomStates.Lock()
+	delete(roomStates.m, "sell")
+	roomStates.Unlock()
+	r, err = lockRoomState("sell", getCurrentTime())
+	assert.Nil(err)
+	assert.Equal(milliIsu.String(), r.state.MilliIsuAt(now+1000).String())
+	r.mu.Unlock()
+
+	sellings, err := store.LoadSellings("sell")
+	assert.Nil(err)
+	assert.Len(sellings, 1)
+	assert.Equal(now+500, sellings[0].BoughtTime)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const healthCheckTimeout = time.Second
+
+// initStore が終わったかどうか。終わるまで db と client には触らない
+var backends = struct {
+	sync.Mutex
+	initialized bool
+}{}
+
+func markBackendsInitialized() {
+	backends.Lock()
+	backends.initialized = true
+	backends.Unlock()
+}
+
+func backendsInitialized() bool {
+	backends.Lock()
+	defer backends.Unlock()
+	return backends.initialized
+}
+
+// 動いている roomHandler の数
+var roomWorkers int64
+
+// rooms に入っている部屋の数
+func countRooms() int {
+	n := 0
+	rooms.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+type BackendHealth struct {
+	Status    string `json:"status"` // ok, error, connecting, disabled
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+type Health struct {
+	Status       string        `json:"status"` // ok, unavailable
+	Ready        bool          `json:"ready"`
+	ShuttingDown bool          `json:"shutting_down"`
+	MySQL        BackendHealth `json:"mysql"`
+	Redis        BackendHealth `json:"redis"`
+	Rooms        int           `json:"rooms"`
+	RoomWorkers  int64         `json:"room_workers"`
+	Connections  int           `json:"connections"`
+	Goroutines   int           `json:"goroutines"`
+}
+
+func checkBackend(ping func(ctx context.Context) error) BackendHealth {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := ping(ctx)
+	h := BackendHealth{Status: "ok", LatencyMS: int64(time.Since(start) / time.Millisecond)}
+	if err != nil {
+		h.Status = "error"
+		h.Error = err.Error()
+	}
+	return h
+}
+
+func checkHealth() Health {
+	h := Health{
+		ShuttingDown: isShuttingDown(),
+		RoomWorkers:  atomic.LoadInt64(&roomWorkers),
+		Connections:  countConns(),
+		Goroutines:   runtime.NumGoroutine(),
+		Rooms:        countRooms(),
+	}
+
+	switch {
+	case currentConfig().Store == "memory":
+		h.MySQL = BackendHealth{Status: "disabled"}
+		h.Redis = BackendHealth{Status: "disabled"}
+	case !backendsInitialized():
+		h.MySQL = BackendHealth{Status: "connecting"}
+		h.Redis = BackendHealth{Status: "connecting"}
+	default:
+		h.MySQL = checkBackend(db.PingContext)
+		h.Redis = checkBackend(func(ctx context.Context) error {
+			return client.WithContext(ctx).Ping().Err()
+		})
+	}
+
+	h.Ready = backendsInitialized() && !h.ShuttingDown &&
+		h.MySQL.Status != "error" && h.Redis.Status != "error"
+	h.Status = "ok"
+	if !h.Ready {
+		h.Status = "unavailable"
+	}
+	return h
+}
+
+func writeHealth(w http.ResponseWriter, h Health, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(h)
+}
+
+// プロセスが応答できれば 200 を返す
+func getHealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, checkHealth(), http.StatusOK)
+}
+
+// MySQL と Redis に繋がり、シャットダウン中でなければ 200 を返す
+func getReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	h := checkHealth()
+	code := http.StatusOK
+	if !h.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, h, code)
+}
+
+// initStore が終わるまで 503 を返す
+func requireBackends(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !backendsInitialized() {
+			http.Error(w, "backends are not ready", http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyz(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+	restore := overrideConfig(func(c *Config) { c.Store = "memory" })
+	defer func() {
+		restore()
+		backends.Lock()
+		backends.initialized = false
+		backends.Unlock()
+	}()
+
+	get := func(h http.HandlerFunc) (int, Health) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		var health Health
+		assert.Nil(json.Unmarshal(w.Body.Bytes(), &health))
+		return w.Code, health
+	}
+
+	code, h := get(getReadyzHandler)
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.False(h.Ready)
+	code, h = get(getHealthzHandler)
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("unavailable", h.Status)
+
+	markBackendsInitialized()
+	code, h = get(getReadyzHandler)
+	assert.Equal(http.StatusOK, code)
+	assert.True(h.Ready)
+	assert.Equal("disabled", h.MySQL.Status)
+	assert.Equal("disabled", h.Redis.Status)
+}
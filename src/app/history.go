@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"app/game"
+)
+
+var errRoomNotFound = errors.New("room not found")
+
+// 時刻 at に部屋がどうなっていたかを作り直す。部屋の時計やキャッシュには触らない。
+// イベントログがあれば at までに受理したイベントを全て反映し、
+// 無ければ store の adding と buying のうち at までのものを使う
+func historicalRoomState(roomName string, at int64) (*roomState, error) {
+	events, err := eventLog.Events(roomName, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return historicalRoomStateFromStore(roomName, at, nil)
+	}
+	if at < events[0].CreatedAt {
+		// store の履歴は、イベントログに移したときに最初のイベントで残したルールで計算する
+		var rs *roomRuleset
+		if events[0].Type == eventRulesetSet {
+			rs, err = parseRoomRuleset(events[0].Ruleset)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return historicalRoomStateFromStore(roomName, at, rs)
+	}
+
+	lastReset, err := eventLog.LastReset()
+	if err != nil {
+		return nil, err
+	}
+
+	s := newRoomState(currentItems(), 0)
+	for _, e := range events {
+		if at < e.CreatedAt {
+			break
+		}
+		s.apply(e)
+	}
+	// at までに全ての部屋をリセットしていて、まだ RoomReset を追記していなければここで反映する
+	if e, ok := s.pendingReset(lastReset); ok && lastReset <= at {
+		s.apply(e)
+	}
+	s.Advance(at)
+	return s, nil
+}
+
+// rs が nil なら既定のルールを使う
+func historicalRoomStateFromStore(roomName string, at int64, rs *roomRuleset) (*roomState, error) {
+	addings, err := store.LoadAddings(roomName)
+	if err != nil {
+		return nil, err
+	}
+	buyings, err := store.LoadBuyings(roomName)
+	if err != nil {
+		return nil, err
+	}
+	sellings, err := store.LoadSellings(roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	// いつ受理したかは分からないので、効果が出る時刻で判断する。
+	// at より後に売ったものは at の時点ではまだ持っている
+	n := 0
+	for _, sl := range sellings {
+		if sl.Time <= at {
+			sellings[n] = sl
+			n++
+		} else {
+			buyings = append(buyings, game.Buying{RoomName: roomName, ItemID: sl.ItemID, Ordinal: sl.Ordinal, Time: sl.BoughtTime})
+		}
+	}
+	sellings = sellings[:n]
+	n = 0
+	for _, a := range addings {
+		if a.Time <= at {
+			addings[n] = a
+			n++
+		}
+	}
+	addings = addings[:n]
+	n = 0
+	for _, b := range buyings {
+		if b.Time <= at {
+			buyings[n] = b
+			n++
+		}
+	}
+	buyings = buyings[:n]
+	if len(addings) == 0 && len(buyings) == 0 && len(sellings) == 0 {
+		return nil, errRoomNotFound
+	}
+	rules := game.Rules{Items: currentItems()}
+	if rs != nil {
+		rules = rs.rules()
+	}
+	return &roomState{State: game.ReplayWithSellings(rules, at, addings, buyings, sellings), ruleset: rs, started: true}, nil
+}
+
+// GET /room/{room_name}/status?at=<ms> で、過去の時刻 at の GameStatus を返す。
+// horizon と encoding は WebSocket の getStatus と setEncoding と同じ
+func getRoomStatusHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	at, err := strconv.ParseInt(query.Get("at"), 10, 64)
+	if err != nil || at < 0 {
+		http.Error(w, "at must be a time in milliseconds", 400)
+		return
+	}
+	if getCurrentTime() < at {
+		http.Error(w, "at must not be in the future", 400)
+		return
+	}
+	var horizon int64
+	if s := query.Get("horizon"); s != "" {
+		horizon, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || horizon < 0 {
+			http.Error(w, errInvalidHorizon.Error(), 400)
+			return
+		}
+	}
+	enc, err := game.ParseEncoding(query.Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	roomName := mux.Vars(r)["room_name"]
+	state, err := historicalRoomState(roomName, at)
+	if err == errRoomNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	if err != nil {
+		logger.Error("failed to load room history", "room", roomName, "at", at, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	status := state.Status(state.statusHorizon(horizon))
+	status.Time = at
+	b, err := status.Encode(enc)
+	if err != nil {
+		logger.Error("failed to encode status", "room", roomName, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+func TestGetRoomStatusAt(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	for i, e := range []RoomEvent{
+		{Type: eventIsuAdded, Time: 1000, Isu: "10", CreatedAt: 1000},
+		{Type: eventItemBought, Time: 1500, ItemID: 1, Ordinal: 1, CreatedAt: 1500},
+		{Type: eventIsuAdded, Time: 5000, Isu: "7", CreatedAt: 2000},
+		{Type: eventIsuAdded, Time: 3000, Isu: "100", CreatedAt: 3000},
+	} {
+		_, err := eventLog.Append("h", int64(i), e)
+		assert.Nil(err)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/room/{room_name}/status", getRoomStatusHandler)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// 2500 の時点では 3000 の addIsu はまだ受理されていない
+	expected := newRoomState(currentItems(), 0)
+	expected.AddIsu(1000, game.Str2Big("10"))
+	expected.Buy(game.Buying{ItemID: 1, Ordinal: 1, Time: 1500})
+	expected.AddIsu(5000, game.Str2Big("7"))
+	expected.Advance(2500)
+	status := expected.Status(3000)
+	status.Time = 2500
+
+	w := get("/room/h/status?at=2500&horizon=3000")
+	assert.Equal(200, w.Code)
+	var actual game.Status
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &actual))
+	assert.Equal(status, &actual)
+	assert.Len(actual.Schedule, 2)
+
+	w = get("/room/h/status?at=3000&encoding=rounded_decimal")
+	assert.Equal(200, w.Code)
+	var decimal struct {
+		Schedule []struct {
+			MilliIsu string `json:"milli_isu"`
+		} `json:"schedule"`
+	}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &decimal))
+	expected.AddIsu(3000, game.Str2Big("100"))
+	expected.Advance(3000)
+	assert.Equal(expected.MilliIsuAt(3000).String(), decimal.Schedule[0].MilliIsu)
+
+	assert.Equal(404, get("/room/h/status?at=500").Code)
+	assert.Equal(404, get("/room/none/status?at=500").Code)
+	assert.Equal(400, get("/room/h/status").Code)
+	assert.Equal(400, get("/room/h/status?at=99999999999999").Code)
+	assert.Equal(400, get("/room/h/status?at=2500&horizon=-1").Code)
+
+	// 部屋の時計は進んでいない
+	assert.Nil(roomClock.Advance("h", 1))
+}
+
+// イベントログより前の store の履歴は、最初のイベントで残したルールで計算する
+func TestHistoricalRoomStateFromStoreWithRuleset(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	rs := defaultRoomRuleset(currentItems())
+	rs.Name, rs.Speed, rs.StartingIsu = "fast", 3, "100"
+	b, err := json.Marshal(rs)
+	assert.Nil(err)
+	assert.Nil(store.AddIsu("hr", 1000, big.NewInt(10)))
+	_, err = eventLog.Append("hr", 0,
+		RoomEvent{Type: eventRulesetSet, Ruleset: string(b), CreatedAt: 5000},
+		RoomEvent{Type: eventIsuAdded, Time: 1000, Isu: "10", CreatedAt: 5000},
+	)
+	assert.Nil(err)
+
+	expected := newRoomStateWithRuleset(rs, 0)
+	expected.AddIsu(1000, big.NewInt(10))
+	state, err := historicalRoomState("hr", 2000)
+	assert.Nil(err)
+	assert.Equal(expected.MilliIsuAt(2000), state.MilliIsuAt(2000))
+	assert.Equal(expected.MilliIsuAt(6000), state.MilliIsuAt(6000))
+}
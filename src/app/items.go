@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+
+	"app/game"
+)
+
+// 新しく作る部屋で使うアイテム。読み直すときは map ごと差し替えるので、
+// 作成済みの部屋は読み直す前のアイテムで計算を続ける
+var items = struct {
+	sync.RWMutex
+	m map[int]game.MItem
+}{m: game.DefaultItems()}
+
+// 読み直しても数え続けるように、全てのアイテムで共有する
+var itemMemoStats = &game.MemoStats{}
+
+func itemMemo() game.MemoConfig {
+	return game.MemoConfig{Size: currentConfig().ItemMemoSize, Stats: itemMemoStats}
+}
+
+func currentItems() map[int]game.MItem {
+	items.RLock()
+	defer items.RUnlock()
+	return items.m
+}
+
+// config.Items に従ってアイテムを読み込む。
+// builtin なら組み込みの値、db なら m_item テーブル、それ以外は JSON か YAML のファイル
+func loadItems(source string) (map[int]game.MItem, error) {
+	switch source {
+	case "builtin":
+		return game.NewItemsWithMemo(game.BuiltinItems(), itemMemo())
+	case "db":
+		list := []game.MItem{}
+		err := db.Select(&list, "SELECT * FROM m_item ORDER BY item_id")
+		if err != nil {
+			return nil, err
+		}
+		return game.NewItemsWithMemo(list, itemMemo())
+	}
+
+	b, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	list := []game.MItem{}
+	switch filepath.Ext(source) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &list)
+	default:
+		err = json.Unmarshal(b, &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	m, err := game.NewItemsWithMemo(list, itemMemo())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return m, nil
+}
+
+// アイテムを読み直して差し替え、読み込んだ数を返す。失敗したら今のアイテムを使い続ける
+func reloadItems() (int, error) {
+	source := currentConfig().Items
+	m, err := loadItems(source)
+	if err != nil {
+		return 0, err
+	}
+	m = internItems(m)
+	items.Lock()
+	items.m = m
+	items.Unlock()
+	logger.Info("loaded items", "source", source, "items", len(m))
+	return len(m), nil
+}
+
+// アイテムを読み直してから、そのアイテムを使うルールを読み直す。
+// SIGHUP と POST /admin/items/reload はどちらもこれを使う
+func reloadItemsAndRulesets() (int, int, error) {
+	n, err := reloadItems()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to reload items: %v", err)
+	}
+	m, err := reloadRulesets()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to reload rulesets: %v", err)
+	}
+	return n, m, nil
+}
+
+func mustLoadItems() {
+	if _, _, err := reloadItemsAndRulesets(); err != nil {
+		fatal("failed to load items", "err", err)
+	}
+}
+
+// SIGHUP を受け取るたびにアイテムとルールを読み直す
+func reloadItemsOnSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if !backendsInitialized() {
+			logger.Warn("ignored SIGHUP before backends are initialized")
+			continue
+		}
+		if _, _, err := reloadItemsAndRulesets(); err != nil {
+			logger.Error("failed to reload", "err", err)
+		}
+	}
+}
+
+const (
+	defaultCatalogOrdinals = 10
+	maxCatalogOrdinals     = 100
+)
+
+var errInvalidOrdinals = fmt.Errorf("ordinals must be between 0 and %d", maxCatalogOrdinals)
+
+// 何個目まで載せるかを確かめる。HTTP でも WebSocket でも 0 なら defaultCatalogOrdinals
+func catalogOrdinals(n int) (int, error) {
+	if n == 0 {
+		return defaultCatalogOrdinals, nil
+	}
+	if n < 0 || maxCatalogOrdinals < n {
+		return 0, errInvalidOrdinals
+	}
+	return n, nil
+}
+
+// ordinals クエリを読む。空なら 0 と同じ
+func parseCatalogOrdinals(s string) (int, error) {
+	if s == "" {
+		return defaultCatalogOrdinals, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errInvalidOrdinals
+	}
+	return catalogOrdinals(n)
+}
+
+// 新しく作る部屋で使うアイテムの一覧を返す。ETag は Catalog の Version
+func getItemsHandler(w http.ResponseWriter, r *http.Request) {
+	ordinals, err := parseCatalogOrdinals(r.URL.Query().Get("ordinals"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	enc, err := game.ParseEncoding(r.URL.Query().Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	m := currentItems()
+	// 表現が違えば中身も違うので ETag も分ける
+	etag := `"` + game.CatalogVersion(m) + `"`
+	if enc != game.EncodingArray {
+		etag = `"` + game.CatalogVersion(m) + "-" + string(enc) + `"`
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+
+	b, err := game.NewCatalog(m, ordinals).Encode(enc)
+	if err != nil {
+		logger.Error("failed to encode items", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// SIGHUP と同じくアイテムとルールを読み直す。requireAdmin の後ろに置く
+func postReloadItemsHandler(w http.ResponseWriter, r *http.Request) {
+	n, m, err := reloadItemsAndRulesets()
+	if err != nil {
+		logger.Error("failed to reload", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Items    int `json:"items"`
+		Rulesets int `json:"rulesets"`
+	}{
+		Items:    n,
+		Rulesets: m,
+	})
+}
+
+// Authorization: Bearer <config.AdminToken> が無ければ 403 を返す。
+// config.AdminToken が空なら誰も使えない
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().AdminToken
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+func TestLoadItems(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "items")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	jsonPath := filepath.Join(dir, "items.json")
+	assert.Nil(ioutil.WriteFile(jsonPath, []byte(`[
+		{"item_id": 1, "power1": 0, "power2": 1, "power3": 0, "power4": 10, "price1": 0, "price2": 1, "price3": 0, "price4": 10},
+		{"item_id": 2, "power1": 1, "power2": 1, "power3": 3, "power4": 2, "price1": 1, "price2": 1, "price3": 7, "price4": 6}
+	]`), 0644))
+	yamlPath := filepath.Join(dir, "items.yaml")
+	assert.Nil(ioutil.WriteFile(yamlPath, []byte(`
+- {item_id: 1, power1: 0, power2: 1, power3: 0, power4: 10, price1: 0, price2: 1, price3: 0, price4: 10}
+- {item_id: 2, power1: 1, power2: 1, power3: 3, power4: 2, price1: 1, price2: 1, price3: 7, price4: 6}
+- item_id: 3
+  power_formula: {type: expr, expr: "x * 10"}
+  price_formula:
+    type: capped
+    max: "100"
+    of: {type: exponential, base: 2}
+`), 0644))
+
+	fromJSON, err := loadItems(jsonPath)
+	assert.Nil(err)
+	assert.Len(fromJSON, 2)
+	fromYAML, err := loadItems(yamlPath)
+	assert.Nil(err)
+	x, y := fromJSON[1], fromYAML[1]
+	assert.Equal(x.GetPrice(3), y.GetPrice(3))
+	assert.Equal(int64(6), fromYAML[2].Price4)
+	z := fromYAML[3]
+	assert.Equal("30", z.GetPower(3).String())
+	assert.Equal("100", z.GetPrice(7).String())
+
+	badPath := filepath.Join(dir, "bad.yaml")
+	assert.Nil(ioutil.WriteFile(badPath, []byte("- {item_id: 1, price: 10}\n"), 0644))
+	_, err = loadItems(badPath)
+	assert.NotNil(err)
+
+	// 読み込みに失敗したら今のアイテムのまま
+	restore := overrideConfig(func(c *Config) { c.Items = jsonPath })
+	defer func() {
+		restore()
+		reloadItems()
+	}()
+	n, err := reloadItems()
+	assert.Nil(err)
+	assert.Equal(2, n)
+	overrideConfig(func(c *Config) { c.Items = badPath })
+	_, err = reloadItems()
+	assert.NotNil(err)
+	assert.Len(currentItems(), 2)
+}
+
+func TestGetItems(t *testing.T) {
+	assert := assert.New(t)
+
+	get := func(query, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/items"+query, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		getItemsHandler(w, r)
+		return w
+	}
+
+	w := get("?ordinals=2", "")
+	assert.Equal(200, w.Code)
+	var catalog game.Catalog
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &catalog))
+	assert.Len(catalog.Items, len(currentItems()))
+	assert.Len(catalog.Items[0].Price, 2)
+	item := currentItems()[1]
+	assert.Equal(game.Big2Exp(item.GetPrice(2)), catalog.Items[0].Price[1])
+	assert.Equal(`"`+game.CatalogVersion(currentItems())+`"`, w.Header().Get("ETag"))
+	assert.Equal(game.CatalogVersion(currentItems()), catalog.Version)
+
+	assert.Equal(304, get("", w.Header().Get("ETag")).Code)
+	assert.Equal(400, get("?ordinals=1000", "").Code)
+	w = get("?ordinals=0", "")
+	assert.Equal(200, w.Code)
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &catalog))
+	assert.Len(catalog.Items[0].Price, defaultCatalogOrdinals)
+
+	w = get("?ordinals=2&encoding=rounded_decimal", "")
+	assert.Equal(200, w.Code)
+	assert.NotEqual(`"`+game.CatalogVersion(currentItems())+`"`, w.Header().Get("ETag"))
+	var decimal struct {
+		Items []struct {
+			Price []string `json:"price"`
+		}
+	}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &decimal))
+	assert.Equal(item.GetPrice(2).String(), decimal.Items[0].Price[1])
+	assert.Equal(400, get("?encoding=hex", "").Code)
+}
+
+func TestPostReloadItems(t *testing.T) {
+	assert := assert.New(t)
+
+	post := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/admin/items/reload", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		requireAdmin(postReloadItemsHandler)(w, r)
+		return w
+	}
+
+	// トークンを設定しなければ誰も使えない
+	assert.Equal(403, post("").Code)
+	assert.Equal(403, post("secret").Code)
+
+	restore := overrideConfig(func(c *Config) { c.AdminToken = "secret" })
+	defer restore()
+	assert.Equal(403, post("").Code)
+	assert.Equal(403, post("wrong").Code)
+	w := post("secret")
+	assert.Equal(200, w.Code)
+	var res struct {
+		Items    int `json:"items"`
+		Rulesets int `json:"rulesets"`
+	}
+	assert.Nil(json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(len(game.BuiltinItems()), res.Items)
+	assert.Equal(0, res.Rulesets)
+}
+
+// 部屋のアイテムを読んでも部屋の時計は進まない
+func TestRoomCatalog(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	catalog, err := roomCatalog("c", 0)
+	assert.Nil(err)
+	assert.Equal(game.CatalogVersion(currentItems()), catalog.Version)
+	_, ok := roomClock.(*memoryClock).times["c"]
+	assert.False(ok)
+
+	assert.Nil(tryAddIsu("c", big.NewInt(1), getCurrentTime()+1000))
+	roomClock = newMemoryClock()
+	catalog, err = roomCatalog("c", 1)
+	assert.Nil(err)
+	assert.Len(catalog.Items[0].Power, 1)
+	_, ok = roomClock.(*memoryClock).times["c"]
+	assert.False(ok)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContextLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	l := newLogger(&buf, slog.LevelInfo, "json")
+
+	ctx := withLogAttrs(context.Background(), "room", "a", "remote_addr", "127.0.0.1:1234")
+	reqCtx := withLogAttrs(ctx, "request_id", 3)
+	l.DebugContext(reqCtx, "hidden")
+	l.With("k", "v").InfoContext(reqCtx, "shown")
+
+	var entry map[string]interface{}
+	assert.Nil(json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal("shown", entry["msg"])
+	assert.Equal("a", entry["room"])
+	assert.Equal("127.0.0.1:1234", entry["remote_addr"])
+	assert.Equal(float64(3), entry["request_id"])
+	assert.Equal("v", entry["k"])
+
+	buf.Reset()
+	l.InfoContext(ctx, "no request")
+	assert.Nil(json.Unmarshal(buf.Bytes(), &entry))
+	assert.NotContains(buf.String(), "request_id")
+}
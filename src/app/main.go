@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -12,10 +11,11 @@ import (
 	"net/http/pprof"
 
 	"github.com/go-redis/redis"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/jmoiron/sqlx"
+
+	"app/game"
 )
 
 var (
@@ -24,72 +24,93 @@ var (
 )
 
 func initDB() {
-	db_host := os.Getenv("ISU_DB_HOST")
-	if db_host == "" {
-		db_host = "127.0.0.1"
-	}
-	db_port := os.Getenv("ISU_DB_PORT")
-	if db_port == "" {
-		db_port = "3306"
-	}
-	db_user := os.Getenv("ISU_DB_USER")
-	if db_user == "" {
-		db_user = "root"
-	}
-	db_password := os.Getenv("ISU_DB_PASSWORD")
-	if db_password != "" {
-		db_password = ":" + db_password
+	c := currentConfig().DB
+	password := c.Password
+	if password != "" {
+		password = ":" + password
 	}
 
-	dsn := fmt.Sprintf("%s%s@tcp(%s:%s)/isudb?parseTime=true&loc=Local&charset=utf8mb4",
-		db_user, db_password, db_host, db_port)
+	dsn := fmt.Sprintf("%s%s@tcp(%s:%d)/%s?parseTime=true&loc=Local&charset=utf8mb4",
+		c.User, password, c.Host, c.Port, c.Name)
 
-	log.Printf("Connecting to db: %q", dsn)
-	db, _ = sqlx.Connect("mysql", dsn)
+	logger.Info("connecting to db", "host", c.Host, "port", c.Port, "name", c.Name)
+	var err error
+	db, err = sqlx.Open("mysql", dsn)
+	if err != nil {
+		fatal("failed to open db", "err", err)
+	}
 	for {
 		err := db.Ping()
 		if err == nil {
 			break
 		}
-		log.Println(err)
+		logger.Warn("failed to ping db", "err", err)
 		time.Sleep(time.Second * 3)
 	}
 
-	db.SetMaxOpenConns(20)
-	db.SetConnMaxLifetime(5 * time.Minute)
-	log.Printf("Succeeded to connect db.")
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetConnMaxLifetime(time.Duration(c.ConnMaxLifetime))
+	logger.Info("succeeded to connect db")
+}
+
+// store が memory なら MySQL と Redis を使わずにメモリ上で部屋を管理する
+func initStore() {
+	if currentConfig().Store == "memory" {
+		logger.Info("using in-memory store")
+		store = newMemoryStore()
+		eventLog = newMemoryEventLog()
+		roomClock = newMemoryClock()
+		mustLoadItems()
+		return
+	}
+
+	client = redis_connection()
+	roomClock = newRedisClock(client)
 
-	var addings []Adding
-	db.Select(&addings, "SELECT * FROM adding")
-	for _, adding := range addings {
-		addReqCh <- IsuReq{adding.RoomName, adding.Time, nil}
+	initDB()
+	if err := verifySchema(db); err != nil {
+		fatal("schema version mismatch", "err", err)
 	}
+	s, err := newMySQLStore(db)
+	if err != nil {
+		fatal("failed to load addings", "err", err)
+	}
+	store = s
+	eventLog = newMySQLEventLog(db)
+	mustLoadItems()
 }
 
 func redis_connection() *redis.Client {
-	redis_host := os.Getenv("ISU_REDIS_HOST")
-	redis_port := os.Getenv("ISU_REDIS_PORT")
-	IP_PORT := redis_host + ":" + redis_port
-
 	//redisに接続
+	rc := currentConfig().Redis
 	c := redis.NewClient(&redis.Options{
-		Addr:     IP_PORT,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:     fmt.Sprintf("%s:%d", rc.Host, rc.Port),
+		Password: rc.Password,
+		DB:       rc.DB,
 	})
-	pong, err := c.Ping().Result()
-	fmt.Printf(pong)
+	err := c.Ping().Err()
 	if err != nil {
-		log.Printf("Fail ", err)
+		logger.Warn("failed to ping redis", "err", err)
 	}
 	return c
 }
 
 func getInitializeHandler(w http.ResponseWriter, r *http.Request) {
-	db.MustExec("TRUNCATE TABLE adding")
-	db.MustExec("TRUNCATE TABLE buying")
-	db.MustExec("TRUNCATE TABLE room_time")
-	initCh <- struct{}{}
+	if err := roomClock.Reset(); err != nil {
+		logger.Error("failed to reset room clock", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	if err := store.Reset(); err != nil {
+		logger.Error("failed to reset store", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	if err := resetRoomStates(getCurrentTime()); err != nil {
+		logger.Error("failed to reset rooms", "err", err)
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(204)
 }
 
@@ -114,12 +135,22 @@ func wsGameHandler(w http.ResponseWriter, r *http.Request) {
 
 	roomName := vars["room_name"]
 
+	if isShuttingDown() {
+		http.Error(w, shutdownCloseReason, http.StatusServiceUnavailable)
+		return
+	}
+	enc, err := game.ParseEncoding(r.URL.Query().Get("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
 	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
-		log.Println("Failed to upgrade", err)
+		logger.Warn("failed to upgrade", "room", roomName, "remote_addr", r.RemoteAddr, "err", err)
 		return
 	}
-	go serveGameConn(ws, roomName)
+	go serveGameConn(ws, roomName, &connOptions{encoding: enc})
 }
 
 func attachPprof(router *mux.Router) {
@@ -135,19 +166,43 @@ func attachPprof(router *mux.Router) {
 }
 
 func main() {
-	go isuFilterHandler()
+	args := mustLoadConfig()
+	initLogger()
+	if len(args) > 0 && args[0] == "migrate" {
+		initDB()
+		if err := runMigrate(db, args[1:], os.Stdout); err != nil {
+			fatal("migration failed", "err", err)
+		}
+		return
+	}
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	initDB()
-	client = redis_connection()
+	go isuFilterHandler()
+	// バックエンドに繋がるまでの間も /healthz, /readyz には応答する
+	go func() {
+		initStore()
+		markBackendsInitialized()
+	}()
+	go reloadItemsOnSignal()
 	r := mux.NewRouter()
 	attachPprof(r)
-	r.HandleFunc("/initialize", getInitializeHandler)
+	r.HandleFunc("/healthz", getHealthzHandler)
+	r.HandleFunc("/readyz", getReadyzHandler)
+	r.HandleFunc("/metrics", getMetricsHandler)
+	r.HandleFunc("/initialize", requireBackends(getInitializeHandler))
+	r.HandleFunc("/items", getItemsHandler).Methods("GET")
+	r.HandleFunc("/admin/items/reload", requireBackends(requireAdmin(postReloadItemsHandler))).Methods("POST")
 	r.HandleFunc("/room/", getRoomHandler)
+	r.HandleFunc("/room/{room_name}/status", requireBackends(getRoomStatusHandler)).Methods("GET")
+	r.HandleFunc("/room/{room_name}/forecast", requireBackends(getRoomForecastHandler)).Methods("GET")
+	r.HandleFunc("/room/{room_name}/advice", requireBackends(getRoomAdviceHandler)).Methods("GET")
+	r.HandleFunc("/room/{room_name}", requireBackends(postRoomHandler)).Methods("POST")
 	r.HandleFunc("/room/{room_name}", getRoomHandler)
-	r.HandleFunc("/ws/", wsGameHandler)
-	r.HandleFunc("/ws/{room_name}", wsGameHandler)
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../public/")))
+	r.HandleFunc("/ws/", requireBackends(wsGameHandler))
+	r.HandleFunc("/ws/{room_name}", requireBackends(wsGameHandler))
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir(currentConfig().PublicDir)))
 
-	log.Fatal(http.ListenAndServe(":5000", handlers.LoggingHandler(os.Stderr, r)))
+	serveUntilSignal(&http.Server{
+		Addr:    currentConfig().Listen,
+		Handler: accessLog(r),
+	})
 }
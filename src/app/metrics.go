@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"app/game"
+)
+
+// Prometheus のテキスト形式で書き出せる最小限のメトリクス
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // ラベルの値を \xff でつないだもの => 値
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Get(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([]float64, len(keys))
+	for i, k := range keys {
+		values[i] = c.values[k]
+	}
+	c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for i, k := range keys {
+		var labelValues []string
+		if len(c.labels) > 0 {
+			labelValues = strings.Split(k, "\xff")
+		}
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, labelValues), formatFloat(values[i]))
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // buckets[i] 以下の観測数 (累積ではない)
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
+
+func writeCounter(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// 0.5ms から 2.5s まで
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+var (
+	actionsTotal = newCounterVec("isu_actions_total",
+		"Game actions by action, result and rejection reason.", "action", "result", "reason")
+	calcStatusSeconds = newHistogram("isu_calc_status_seconds",
+		"Time to compute a GameStatus from the room state.", latencyBuckets)
+	getStatusSeconds = newHistogram("isu_get_status_seconds",
+		"Time to advance the room clock, load the room state and compute a GameStatus.", latencyBuckets)
+	statusGroupTotal = newCounterVec("isu_status_group_calls_total",
+		"getStatusWithGroup calls by whether the result was shared with another caller.", "shared")
+)
+
+const (
+	reasonRoomTimeFuture = "room_time_future"
+	reasonReqTimePast    = "req_time_past"
+	reasonAlreadyBought  = "already_bought"
+	reasonNotEnough      = "not_enough"
+	reasonInvalidItem    = "invalid_item"
+	reasonInvalidHorizon = "invalid_horizon"
+	reasonInvalidCount   = "invalid_count"
+	reasonNotBuilt       = "not_built"
+	reasonConflict       = "conflict"
+	reasonError          = "error"
+)
+
+func actionRejectReason(err error) string {
+	switch err {
+	case errRoomTimeFuture:
+		return reasonRoomTimeFuture
+	case errReqTimePast:
+		return reasonReqTimePast
+	case errAlreadyBought:
+		return reasonAlreadyBought
+	case errNotEnough:
+		return reasonNotEnough
+	case errInvalidItem:
+		return reasonInvalidItem
+	case errInvalidHorizon:
+		return reasonInvalidHorizon
+	case errInvalidCount:
+		return reasonInvalidCount
+	case errNotBuilt:
+		return reasonNotBuilt
+	case errEventConflict:
+		return reasonConflict
+	}
+	return reasonError
+}
+
+// 操作の結果を数えて、そのまま成否を返す
+func observeAction(action string, err error) bool {
+	if err != nil {
+		actionsTotal.Inc(action, "rejected", actionRejectReason(err))
+		return false
+	}
+	actionsTotal.Inc(action, "accepted", "")
+	return true
+}
+
+func writeMetrics(w io.Writer) {
+	actionsTotal.write(w)
+	calcStatusSeconds.write(w)
+	getStatusSeconds.write(w)
+	statusGroupTotal.write(w)
+
+	shared := statusGroupTotal.Get("true")
+	total := shared + statusGroupTotal.Get("false")
+	ratio := 0.0
+	if total > 0 {
+		ratio = shared / total
+	}
+	writeGauge(w, "isu_status_group_share_ratio", "Fraction of getStatusWithGroup calls that shared a result.", ratio)
+
+	hits, misses := float64(itemMemoStats.Hits()), float64(itemMemoStats.Misses())
+	writeCounter(w, "isu_item_memo_hits_total", "GetPower and GetPrice calls answered from the buffer or the memo.", hits)
+	writeCounter(w, "isu_item_memo_misses_total", "GetPower and GetPrice calls that had to compute the value.", misses)
+	hitRatio := 0.0
+	if hits+misses > 0 {
+		hitRatio = hits / (hits + misses)
+	}
+	writeGauge(w, "isu_item_memo_hit_ratio", "Fraction of GetPower and GetPrice calls answered without computing.", hitRatio)
+	writeGauge(w, "isu_item_memo_entries", "Powers and prices remembered beyond the precomputed buffer.", float64(game.MemoEntries(currentItems())))
+
+	writeGauge(w, "isu_websocket_connections", "Open WebSocket connections.", float64(countConns()))
+	writeGauge(w, "isu_active_rooms", "Rooms with at least one connection.", float64(countRooms()))
+}
+
+func getMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw)
+	bw.Flush()
+}
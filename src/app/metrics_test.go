@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActionMetrics(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+	actionsTotal.values = map[string]float64{}
+
+	ctx := context.Background()
+	now := getCurrentTime()
+	assert.True(addIsu(ctx, "metrics", big.NewInt(10), now+1000))
+	assert.False(addIsu(ctx, "metrics", big.NewInt(1), now-1000))
+	assert.False(buyItem(ctx, "metrics", 1, 0, now+500))
+	assert.True(buyItem(ctx, "metrics", 1, 0, now+1000))
+	assert.False(buyItem(ctx, "metrics", 1, 0, now+1000))
+	assert.False(buyItem(ctx, "metrics", 99, 0, now+1000))
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	out := buf.String()
+	assert.Contains(out, "# TYPE isu_actions_total counter\n")
+	assert.Contains(out, `isu_actions_total{action="addIsu",result="accepted",reason=""} 1`)
+	assert.Contains(out, `isu_actions_total{action="addIsu",result="rejected",reason="req_time_past"} 1`)
+	assert.Contains(out, `isu_actions_total{action="buyItem",result="rejected",reason="not_enough"} 1`)
+	assert.Contains(out, `isu_actions_total{action="buyItem",result="accepted",reason=""} 1`)
+	assert.Contains(out, `isu_actions_total{action="buyItem",result="rejected",reason="already_bought"} 1`)
+	assert.Contains(out, `isu_actions_total{action="buyItem",result="rejected",reason="invalid_item"} 1`)
+	assert.Contains(out, "# TYPE isu_get_status_seconds histogram\n")
+	assert.Contains(out, "# TYPE isu_item_memo_hits_total counter\n")
+	assert.Contains(out, "isu_item_memo_hit_ratio ")
+	assert.Contains(out, "isu_active_rooms ")
+}
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	h := newHistogram("x", "help", []float64{1, 2})
+	h.Observe(0.5)
+	h.Observe(2)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	assert.Equal("# HELP x help\n# TYPE x histogram\n"+
+		"x_bucket{le=\"1\"} 1\nx_bucket{le=\"2\"} 2\nx_bucket{le=\"+Inf\"} 3\n"+
+		"x_sum 5.5\nx_count 3\n", buf.String())
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrations/NNNN_name.up.sql と migrations/NNNN_name.down.sql の組
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrations = loadMigrations()
+
+// game.go などのクエリが前提としているスキーマのバージョン
+var schemaVersion = migrations[len(migrations)-1].Version
+
+func loadMigrations() []migration {
+	files, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		panic(err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		name := f.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			panic("unknown migration file: " + name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		i := strings.Index(base, "_")
+		if i < 0 {
+			panic("invalid migration file name: " + name)
+		}
+		version, err := strconv.Atoi(base[:i])
+		if err != nil {
+			panic("invalid migration file name: " + name)
+		}
+		body, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			panic(err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	result := []migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			panic(fmt.Sprintf("migration %04d must have both up and down", m.Version))
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+	for i, m := range result {
+		if m.Version != i+1 {
+			panic(fmt.Sprintf("migration %04d is missing", i+1))
+		}
+	}
+	return result
+}
+
+// セミコロンで区切られた SQL を1文ずつに分ける
+func splitStatements(sql string) []string {
+	result := []string{}
+	for _, stmt := range strings.Split(sql, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" {
+			result = append(result, stmt)
+		}
+	}
+	return result
+}
+
+func ensureMigrationTable(db *sqlx.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version INT NOT NULL PRIMARY KEY, applied_at DATETIME NOT NULL" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	return err
+}
+
+// 適用済みの最新のバージョンを返す。何も適用していなければ 0
+func currentSchemaVersion(db *sqlx.DB) (int, error) {
+	if err := ensureMigrationTable(db); err != nil {
+		return 0, err
+	}
+	var version int
+	err := db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	return version, err
+}
+
+func execStatements(db *sqlx.DB, sql string) error {
+	for _, stmt := range splitStatements(sql) {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 未適用のマイグレーションを全て適用する
+func migrateUp(db *sqlx.DB, w io.Writer) error {
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if err := execStatements(db, m.Up); err != nil {
+			return fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		_, err := db.Exec("INSERT INTO schema_migrations(version, applied_at) VALUES (?, ?)", m.Version, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "applied %04d_%s\n", m.Version, m.Name)
+	}
+	return nil
+}
+
+// 最後に適用したマイグレーションを1つ戻す
+func migrateDown(db *sqlx.DB, w io.Writer) error {
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		fmt.Fprintln(w, "no migration to revert")
+		return nil
+	}
+	m := migrations[version-1]
+	if err := execStatements(db, m.Down); err != nil {
+		return fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+	}
+	_, err = db.Exec("DELETE FROM schema_migrations WHERE version = ?", m.Version)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "reverted %04d_%s\n", m.Version, m.Name)
+	return nil
+}
+
+func migrateStatus(db *sqlx.DB, w io.Writer) error {
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if m.Version <= version {
+			state = "applied"
+		}
+		fmt.Fprintf(w, "%04d_%s\t%s\n", m.Version, m.Name, state)
+	}
+	fmt.Fprintf(w, "current version: %d, expected version: %d\n", version, schemaVersion)
+	return nil
+}
+
+// app migrate up|down|status
+func runMigrate(db *sqlx.DB, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: app migrate up|down|status")
+	}
+	switch args[0] {
+	case "up":
+		return migrateUp(db, w)
+	case "down":
+		return migrateDown(db, w)
+	case "status":
+		return migrateStatus(db, w)
+	}
+	return fmt.Errorf("unknown migrate command: %s", args[0])
+}
+
+// スキーマのバージョンが schemaVersion と一致しているか確かめる
+func verifySchema(db *sqlx.DB) error {
+	version, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version != schemaVersion {
+		return fmt.Errorf("schema version is %d but %d is expected; run `app migrate up`", version, schemaVersion)
+	}
+	return nil
+}
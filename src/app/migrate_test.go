@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NotEmpty(migrations)
+	for i, m := range migrations {
+		assert.Equal(i+1, m.Version)
+		assert.NotEmpty(splitStatements(m.Up), m.Name)
+		assert.NotEmpty(splitStatements(m.Down), m.Name)
+	}
+	assert.Equal(len(migrations), schemaVersion)
+}
+
+func TestSplitStatements(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"DROP TABLE a", "DROP TABLE b"}, splitStatements("DROP TABLE a;\n\nDROP TABLE b;\n"))
+	assert.Empty(splitStatements(" \n"))
+}
@@ -0,0 +1,2 @@
+DROP TABLE buying;
+DROP TABLE adding;
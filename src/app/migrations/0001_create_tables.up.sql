@@ -0,0 +1,14 @@
+CREATE TABLE adding (
+  room_name VARCHAR(191) NOT NULL,
+  time BIGINT NOT NULL,
+  isu TEXT NOT NULL,
+  PRIMARY KEY (room_name, time)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE buying (
+  room_name VARCHAR(191) NOT NULL,
+  item_id INT UNSIGNED NOT NULL,
+  ordinal INT UNSIGNED NOT NULL,
+  time BIGINT NOT NULL,
+  PRIMARY KEY (room_name, item_id, ordinal)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE room_snapshot;
+DROP TABLE room_event;
@@ -0,0 +1,19 @@
+CREATE TABLE room_event (
+  room_name VARCHAR(191) NOT NULL,
+  seq BIGINT NOT NULL,
+  type VARCHAR(32) NOT NULL,
+  time BIGINT NOT NULL,
+  isu TEXT NOT NULL,
+  item_id INT UNSIGNED NOT NULL DEFAULT 0,
+  ordinal INT UNSIGNED NOT NULL DEFAULT 0,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (room_name, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE room_snapshot (
+  room_name VARCHAR(191) NOT NULL,
+  seq BIGINT NOT NULL,
+  time BIGINT NOT NULL,
+  state LONGTEXT NOT NULL,
+  PRIMARY KEY (room_name, seq)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1 @@
+ALTER TABLE room_event ADD COLUMN horizon BIGINT NOT NULL DEFAULT 0 AFTER ordinal;
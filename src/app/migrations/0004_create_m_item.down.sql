@@ -0,0 +1 @@
+DROP TABLE m_item;
@@ -0,0 +1,26 @@
+CREATE TABLE m_item (
+  item_id INT UNSIGNED NOT NULL PRIMARY KEY,
+  power1 BIGINT NOT NULL,
+  power2 BIGINT NOT NULL,
+  power3 BIGINT NOT NULL,
+  power4 BIGINT NOT NULL,
+  price1 BIGINT NOT NULL,
+  price2 BIGINT NOT NULL,
+  price3 BIGINT NOT NULL,
+  price4 BIGINT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT INTO m_item (item_id, power1, power2, power3, power4, price1, price2, price3, price4) VALUES
+  (1, 0, 1, 0, 1, 0, 1, 1, 1),
+  (2, 0, 1, 1, 1, 0, 1, 2, 1),
+  (3, 1, 10, 0, 2, 1, 3, 1, 2),
+  (4, 1, 24, 1, 2, 1, 10, 0, 3),
+  (5, 1, 25, 100, 3, 2, 20, 20, 2),
+  (6, 1, 30, 147, 13, 1, 22, 69, 17),
+  (7, 5, 80, 128, 6, 6, 61, 200, 5),
+  (8, 20, 340, 180, 3, 9, 105, 134, 14),
+  (9, 55, 520, 335, 5, 48, 243, 600, 7),
+  (10, 157, 1071, 1700, 12, 157, 625, 1000, 13),
+  (11, 2000, 7500, 2600, 3, 2001, 5430, 1000, 3),
+  (12, 1000, 9000, 0, 17, 963, 7689, 1, 19),
+  (13, 11000, 11000, 11000, 23, 10000, 2, 2, 29);
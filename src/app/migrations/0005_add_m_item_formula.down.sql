@@ -0,0 +1 @@
+ALTER TABLE m_item DROP COLUMN power_formula, DROP COLUMN price_formula;
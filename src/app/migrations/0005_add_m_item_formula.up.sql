@@ -0,0 +1 @@
+ALTER TABLE m_item ADD COLUMN power_formula TEXT NULL, ADD COLUMN price_formula TEXT NULL;
@@ -0,0 +1 @@
+ALTER TABLE room_event DROP COLUMN ruleset;
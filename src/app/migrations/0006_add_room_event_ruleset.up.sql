@@ -0,0 +1 @@
+ALTER TABLE room_event ADD COLUMN ruleset MEDIUMTEXT NOT NULL AFTER horizon;
@@ -0,0 +1,10 @@
+CREATE TABLE selling (
+  id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  room_name VARCHAR(191) NOT NULL,
+  item_id INT UNSIGNED NOT NULL,
+  ordinal INT UNSIGNED NOT NULL,
+  bought_time BIGINT NOT NULL,
+  time BIGINT NOT NULL,
+  refund TEXT NOT NULL,
+  KEY (room_name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
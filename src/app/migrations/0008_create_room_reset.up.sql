@@ -0,0 +1,4 @@
+CREATE TABLE room_reset (
+  time BIGINT NOT NULL,
+  PRIMARY KEY (time)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
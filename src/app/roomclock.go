@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+var errRoomTimeFuture = errors.New("room time is future")
+
+// 部屋ごとの時計。部屋の時刻は巻き戻らない
+type RoomClock interface {
+	// 部屋の時刻を now に進める。部屋の時刻が now より先なら errRoomTimeFuture を返す
+	Advance(roomName string, now int64) error
+	// 全ての部屋の時刻を消す
+	Reset() error
+}
+
+var roomClock RoomClock
+
+const redisRoomTimeKey = "room_time"
+
+// 比較と更新を Redis 側で1度に行うので、他のリクエストやサーバーと競合しない
+var advanceRoomTimeScript = redis.NewScript(`
+local cur = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+local now = tonumber(ARGV[2])
+if cur > now then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// 部屋の時刻を Redis のハッシュ room_time に持つ RoomClock
+type redisClock struct {
+	client *redis.Client
+}
+
+func newRedisClock(client *redis.Client) *redisClock {
+	return &redisClock{client: client}
+}
+
+func (c *redisClock) Advance(roomName string, now int64) error {
+	ok, err := advanceRoomTimeScript.Run(c.client, []string{redisRoomTimeKey}, roomName, strconv.FormatInt(now, 10)).Int64()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return errRoomTimeFuture
+	}
+	return nil
+}
+
+func (c *redisClock) Reset() error {
+	return c.client.Del(redisRoomTimeKey).Err()
+}
+
+// プロセス内で完結する RoomClock
+type memoryClock struct {
+	mu    sync.Mutex
+	times map[string]int64
+}
+
+func newMemoryClock() *memoryClock {
+	return &memoryClock{times: map[string]int64{}}
+}
+
+func (c *memoryClock) Advance(roomName string, now int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.times[roomName] > now {
+		return errRoomTimeFuture
+	}
+	c.times[roomName] = now
+	return nil
+}
+
+func (c *memoryClock) Reset() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.times = map[string]int64{}
+	return nil
+}
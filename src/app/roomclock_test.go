@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisClock(t *testing.T) (*redisClock, func()) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	return newRedisClock(c), func() {
+		c.Close()
+		s.Close()
+	}
+}
+
+func testRoomClock(t *testing.T, c RoomClock) {
+	assert := assert.New(t)
+
+	assert.Nil(c.Advance("a", 100))
+	assert.Nil(c.Advance("a", 100))
+	assert.Nil(c.Advance("a", 1500000000000))
+	assert.Equal(errRoomTimeFuture, c.Advance("a", 1499999999999))
+	assert.Nil(c.Advance("b", 200))
+
+	assert.Nil(c.Reset())
+	assert.Nil(c.Advance("a", 200))
+}
+
+func TestRedisClock(t *testing.T) {
+	c, cleanup := newTestRedisClock(t)
+	defer cleanup()
+	testRoomClock(t, c)
+}
+
+func TestMemoryClock(t *testing.T) {
+	testRoomClock(t, newMemoryClock())
+}
+
+// 同時に更新しても部屋の時刻は巻き戻らない
+func TestRedisClockConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	c, cleanup := newTestRedisClock(t)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := int64(1); i <= 50; i++ {
+		wg.Add(1)
+		go func(now int64) {
+			defer wg.Done()
+			err := c.Advance("a", now)
+			if err != nil {
+				assert.Equal(errRoomTimeFuture, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Nil(c.Advance("a", 50))
+	assert.Equal(errRoomTimeFuture, c.Advance("a", 49))
+}
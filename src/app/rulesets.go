@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+
+	"app/game"
+)
+
+// 既定のルールの名前。config.Items のアイテムを倍率 1、椅子 0 から使う
+const defaultRulesetName = "default"
+
+var (
+	errUnknownRuleset = errors.New("unknown ruleset")
+	errRoomStarted    = errors.New("room already started")
+)
+
+// config.Rulesets に書く、部屋を作るときに選べるルール
+type Ruleset struct {
+	Name        string `json:"name" yaml:"name"`
+	Items       string `json:"items,omitempty" yaml:"items,omitempty"` // config.Items と同じ書き方。空なら config.Items
+	Speed       int64  `json:"speed,omitempty" yaml:"speed,omitempty"`
+	StartingIsu string `json:"starting_isu,omitempty" yaml:"starting_isu,omitempty"`
+	Horizon     int64  `json:"horizon,omitempty" yaml:"horizon,omitempty"` // ミリ秒。0 ならサーバーの既定値
+}
+
+// 部屋と一緒に保存するルール。アイテムの定義も持つので、
+// 後でファイルを書き換えても作成済みの部屋のルールは変わらない
+type roomRuleset struct {
+	Name        string       `json:"name"`
+	Items       []game.MItem `json:"items"`
+	Speed       int64        `json:"speed,omitempty"`
+	StartingIsu string       `json:"starting_isu,omitempty"`
+	Horizon     int64        `json:"horizon,omitempty"`
+
+	mItems map[int]game.MItem // Items から作ったもの
+}
+
+func (rs *roomRuleset) rules() game.Rules {
+	rules := game.Rules{Items: rs.mItems, Speed: rs.Speed}
+	if rs.StartingIsu != "" {
+		rules.StartingIsu = game.Str2Big(rs.StartingIsu)
+	}
+	return rules
+}
+
+var rulesets = struct {
+	sync.RWMutex
+	m map[string]*roomRuleset
+}{m: map[string]*roomRuleset{}}
+
+// 名前からルールを探す。既定のルールなら nil を返す
+func lookupRuleset(name string) (*roomRuleset, error) {
+	if name == "" || name == defaultRulesetName {
+		return nil, nil
+	}
+	rulesets.RLock()
+	defer rulesets.RUnlock()
+	rs, ok := rulesets.m[name]
+	if !ok {
+		return nil, errUnknownRuleset
+	}
+	return rs, nil
+}
+
+func (r Ruleset) validate() error {
+	if r.Name == "" || r.Name == defaultRulesetName {
+		return fmt.Errorf("invalid ruleset name %q", r.Name)
+	}
+	if r.Speed < 0 {
+		return fmt.Errorf("ruleset %s: speed must not be negative", r.Name)
+	}
+	if r.StartingIsu != "" {
+		if isu, ok := new(big.Int).SetString(r.StartingIsu, 10); !ok || isu.Sign() < 0 {
+			return fmt.Errorf("ruleset %s: invalid starting_isu %q", r.Name, r.StartingIsu)
+		}
+	}
+	if r.Horizon < 0 || time.Duration(currentConfig().MaxStatusHorizon).Milliseconds() < r.Horizon {
+		return fmt.Errorf("ruleset %s: horizon must be between 0 and max_status_horizon", r.Name)
+	}
+	return nil
+}
+
+// config.Rulesets のファイルを読んでルールを作る
+func loadRulesets(path string) (map[string]*roomRuleset, error) {
+	m := map[string]*roomRuleset{}
+	if path == "" {
+		return m, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := []Ruleset{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &list)
+	default:
+		err = json.Unmarshal(b, &list)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for _, r := range list {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if _, ok := m[r.Name]; ok {
+			return nil, fmt.Errorf("%s: duplicate ruleset %s", path, r.Name)
+		}
+		source := r.Items
+		if source == "" {
+			source = currentConfig().Items
+		}
+		mItems, err := loadItems(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: ruleset %s: %v", path, r.Name, err)
+		}
+		rs := &roomRuleset{
+			Name:        r.Name,
+			Speed:       r.Speed,
+			StartingIsu: r.StartingIsu,
+			Horizon:     r.Horizon,
+			mItems:      internItems(mItems),
+		}
+		for _, itemID := range game.SortedItemIDs(mItems) {
+			rs.Items = append(rs.Items, mItems[itemID])
+		}
+		m[r.Name] = rs
+	}
+	return m, nil
+}
+
+// ルールを読み直して差し替え、読み込んだ数を返す。作成済みの部屋は元のルールのまま
+func reloadRulesets() (int, error) {
+	source := currentConfig().Rulesets
+	m, err := loadRulesets(source)
+	if err != nil {
+		return 0, err
+	}
+	rulesets.Lock()
+	rulesets.m = m
+	rulesets.Unlock()
+	logger.Info("loaded rulesets", "source", source, "rulesets", len(m))
+	return len(m), nil
+}
+
+// mItems を倍率 1、椅子 0 から使う既定のルール。部屋と一緒に保存しておけば、
+// アイテムを読み直しても作成済みの部屋は作ったときのアイテムのまま
+func defaultRoomRuleset(mItems map[int]game.MItem) *roomRuleset {
+	// 作り直すときに resolve が同じアイテムを使えるように登録しておく
+	rs := &roomRuleset{Name: defaultRulesetName, mItems: internItems(mItems)}
+	for _, itemID := range game.SortedItemIDs(mItems) {
+		rs.Items = append(rs.Items, mItems[itemID])
+	}
+	return rs
+}
+
+// 読み込んだことのあるアイテムの定義。
+// 同じ定義のアイテムはバッファとメモを共有する
+var itemCatalogs = struct {
+	sync.Mutex
+	m map[string]map[int]game.MItem // Catalog の Version => アイテム
+}{m: map[string]map[int]game.MItem{}}
+
+// 同じ定義のアイテムを読み込んだことがあればそれを返す
+func internItems(mItems map[int]game.MItem) map[int]game.MItem {
+	version := game.CatalogVersion(mItems)
+	itemCatalogs.Lock()
+	defer itemCatalogs.Unlock()
+	if m, ok := itemCatalogs.m[version]; ok {
+		return m
+	}
+	itemCatalogs.m[version] = mItems
+	return mItems
+}
+
+// 保存してあったルールを読む。空文字列なら既定のルールとして nil を返す
+func parseRoomRuleset(s string) (*roomRuleset, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rs := &roomRuleset{}
+	if err := json.Unmarshal([]byte(s), rs); err != nil {
+		return nil, err
+	}
+	if err := rs.resolve(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Items から mItems を作る
+func (rs *roomRuleset) resolve() error {
+	plain := make(map[int]game.MItem, len(rs.Items))
+	for _, item := range rs.Items {
+		plain[item.ItemID] = item
+	}
+	itemCatalogs.Lock()
+	m, ok := itemCatalogs.m[game.CatalogVersion(plain)]
+	itemCatalogs.Unlock()
+	if ok {
+		rs.mItems = m
+		return nil
+	}
+
+	m, err := game.NewItemsWithMemo(rs.Items, itemMemo())
+	if err != nil {
+		return err
+	}
+	rs.mItems = internItems(m)
+	return nil
+}
+
+// まだ操作を受け付けていない部屋のルールを変える
+func setRoomRuleset(roomName, name string) error {
+	rs, err := lookupRuleset(name)
+	if err != nil {
+		return err
+	}
+	if rs == nil {
+		rs = defaultRoomRuleset(currentItems())
+	}
+	stored, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+
+	currentTime, err := updateRoomTime(roomName, 0)
+	if err != nil {
+		return err
+	}
+	r, err := lockRoomState(roomName, currentTime)
+	if err != nil {
+		return err
+	}
+	defer r.mu.Unlock()
+
+	if r.state.started {
+		return errRoomStarted
+	}
+	// 追記できなければ record が部屋を捨てるので、元に戻さなくてよい
+	r.state.replace(newRoomStateWithRuleset(rs, currentTime))
+	return r.record(roomName, RoomEvent{
+		Type:      eventRulesetSet,
+		Time:      currentTime,
+		Ruleset:   string(stored),
+		CreatedAt: currentTime,
+	})
+}
+
+// POST /room/{room_name} に {"ruleset": "name"} を送ると、その名前のルールで部屋を作る
+func postRoomHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Ruleset string `json:"ruleset"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	roomName := mux.Vars(r)["room_name"]
+	err := setRoomRuleset(roomName, req.Ruleset)
+	switch err {
+	case nil:
+	case errUnknownRuleset:
+		http.Error(w, err.Error(), 404)
+		return
+	case errRoomStarted:
+		http.Error(w, err.Error(), 409)
+		return
+	default:
+		logger.Error("failed to set ruleset", "room", roomName, "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	getRoomHandler(w, r)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+func TestRoomRuleset(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	dir, err := ioutil.TempDir("", "rulesets")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	itemsPath := filepath.Join(dir, "items.json")
+	assert.Nil(ioutil.WriteFile(itemsPath, []byte(`[
+		{"item_id": 1, "power1": 0, "power2": 1, "power3": 0, "power4": 10, "price1": 0, "price2": 1, "price3": 0, "price4": 10}
+	]`), 0644))
+	path := filepath.Join(dir, "rulesets.yaml")
+	assert.Nil(ioutil.WriteFile(path, []byte(`
+- name: blitz
+  items: `+itemsPath+`
+  speed: 10
+  starting_isu: "100"
+  horizon: 5000
+`), 0644))
+
+	restore := overrideConfig(func(c *Config) { c.Rulesets = path })
+	defer func() {
+		restore()
+		reloadRulesets()
+	}()
+	_, err = reloadRulesets()
+	assert.Nil(err)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/room/{room_name}", postRoomHandler).Methods("POST")
+	post := func(roomName, body string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/room/"+roomName, strings.NewReader(body)))
+		return w.Code
+	}
+
+	assert.Equal(404, post("r", `{"ruleset": "unknown"}`))
+	assert.Equal(200, post("r", `{"ruleset": "blitz"}`))
+
+	r, err := lockRoomState("r", 0)
+	assert.Nil(err)
+	assert.Len(r.state.Items(), 1)
+	assert.Equal(int64(5000), r.state.statusHorizon(0))
+	assert.Equal("100000", r.state.MilliIsuAt(r.state.Time()).String())
+	r.mu.Unlock()
+
+	boughtAt := getCurrentTime() + 100
+	assert.Nil(tryBuyItem("r", 1, 0, boughtAt))
+	assert.Equal(409, post("r", `{"ruleset": "default"}`))
+
+	// イベントログから作り直してもルールはそのまま
+	roomStates.Lock()
+	delete(roomStates.m, "r")
+	roomStates.Unlock()
+	rebuilt, err := rebuildRoomState("r")
+	assert.Nil(err)
+	assert.True(rebuilt.started)
+	assert.NotNil(rebuilt.ruleset)
+	assert.Equal("blitz", rebuilt.ruleset.Name)
+	assert.Equal(int64(5000), rebuilt.horizon)
+	rebuilt.Advance(boughtAt + 1000)
+	// 100 - 10 に、生産力 10 の 10 倍で 1 秒分
+	assert.Equal("190000", rebuilt.MilliIsuAt(boughtAt+1000).String())
+}
+
+// 既定のルールの部屋は、アイテムを読み直しても作ったときのアイテムで作り直される
+func TestDefaultRoomKeepsItems(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+
+	currentTime := getCurrentTime()
+	assert.Nil(tryAddIsu("k", big.NewInt(1000), currentTime+1000))
+	assert.Nil(tryBuyItem("k", 1, 0, currentTime+2000))
+
+	old := currentItems()
+	defer func() {
+		items.Lock()
+		items.m = old
+		items.Unlock()
+	}()
+	cheap, err := game.NewItems([]game.MItem{
+		{ItemID: 1, Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 0, Price4: 1},
+	})
+	assert.Nil(err)
+	items.Lock()
+	items.m = cheap
+	items.Unlock()
+
+	roomStates.Lock()
+	roomStates.m = map[string]*cachedRoom{}
+	roomStates.Unlock()
+	r, err := lockRoomState("k", currentTime)
+	assert.Nil(err)
+	assert.Equal(game.CatalogVersion(old), game.CatalogVersion(r.state.Items()))
+	assert.Equal(1, r.state.CountBought(1))
+	r.mu.Unlock()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const shutdownCloseReason = "server is shutting down"
+
+// シャットダウン中かどうかと、処理中の WebSocket 接続と操作
+var lifecycle = struct {
+	sync.Mutex
+	closing bool
+	conns   map[*websocket.Conn]struct{}
+	actions sync.WaitGroup
+}{conns: map[*websocket.Conn]struct{}{}}
+
+func isShuttingDown() bool {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	return lifecycle.closing
+}
+
+// 接続を登録する。シャットダウン中なら false を返す
+func registerConn(ws *websocket.Conn) bool {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	if lifecycle.closing {
+		return false
+	}
+	lifecycle.conns[ws] = struct{}{}
+	return true
+}
+
+func unregisterConn(ws *websocket.Conn) {
+	lifecycle.Lock()
+	delete(lifecycle.conns, ws)
+	lifecycle.Unlock()
+}
+
+func countConns() int {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	return len(lifecycle.conns)
+}
+
+// addIsu, buyItem を始める前に呼ぶ。シャットダウン中なら false を返す
+func beginAction() bool {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	if lifecycle.closing {
+		return false
+	}
+	lifecycle.actions.Add(1)
+	return true
+}
+
+func endAction() {
+	lifecycle.actions.Done()
+}
+
+// ctx の期限まで待つ。期限を過ぎたら false を返す
+func waitUntil(ctx context.Context, done func() bool) bool {
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// 新しい接続と操作を止め、処理中の操作が終わってから各接続に close frame を送り、
+// 接続が閉じるのを待つ。全体で ctx の期限までしか待たない
+func gracefulShutdown(ctx context.Context, srv *http.Server) {
+	lifecycle.Lock()
+	lifecycle.closing = true
+	lifecycle.Unlock()
+
+	go func() {
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warn("failed to shut down http server", "err", err)
+		}
+	}()
+
+	actionsDone := make(chan struct{})
+	go func() {
+		lifecycle.actions.Wait()
+		close(actionsDone)
+	}()
+	select {
+	case <-actionsDone:
+	case <-ctx.Done():
+		logger.Warn("gave up waiting for in-flight actions")
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownCloseReason)
+	lifecycle.Lock()
+	for ws := range lifecycle.conns {
+		if err := ws.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+			logger.Warn("failed to send close frame", "remote_addr", ws.RemoteAddr().String(), "err", err)
+		}
+	}
+	lifecycle.Unlock()
+
+	if !waitUntil(ctx, func() bool { return countConns() == 0 }) {
+		logger.Warn("gave up waiting for connections", "connections", countConns())
+	}
+}
+
+// SIGTERM か SIGINT を受け取ったら shutdown_timeout 以内にサーバーを止める
+func serveUntilSignal(srv *http.Server) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errCh:
+		fatal("http server stopped", "err", err)
+	case sig := <-sigCh:
+		logger.Info("shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(currentConfig().ShutdownTimeout))
+	defer cancel()
+	gracefulShutdown(ctx, srv)
+	logger.Info("shutdown complete")
+}
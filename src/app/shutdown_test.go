@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func useMemoryBackends() {
+	store = newMemoryStore()
+	eventLog = newMemoryEventLog()
+	roomClock = newMemoryClock()
+	resetRoomStates(0)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	assert := assert.New(t)
+	useMemoryBackends()
+	defer func() {
+		lifecycle.Lock()
+		lifecycle.closing = false
+		lifecycle.Unlock()
+	}()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/ws/{room_name}", wsGameHandler)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws/a"
+
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Nil(err)
+	defer ws.Close()
+
+	_, _, err = ws.ReadMessage()
+	assert.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		gracefulShutdown(ctx, ts.Config)
+		close(done)
+	}()
+
+	for {
+		_, _, err = ws.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+	closeErr, ok := err.(*websocket.CloseError)
+	assert.True(ok, err.Error())
+	if ok {
+		assert.Equal(websocket.CloseGoingAway, closeErr.Code)
+		assert.Equal(shutdownCloseReason, closeErr.Text)
+	}
+	ws.Close()
+	<-done
+	assert.Equal(0, countConns())
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NotNil(err)
+	if resp != nil {
+		assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
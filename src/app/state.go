@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"app/game"
+)
+
+// ゲームの状態に、部屋の設定とイベントログの位置を加えたもの
+type roomState struct {
+	*game.State
+
+	ruleset *roomRuleset // nil なら既定のルール
+	horizon int64        // GameStatus で先読みするミリ秒数。0 ならサーバーの既定値
+	started bool         // addIsu, buyItem か sellItem を受け付けたか。受け付けた後はルールを変えられない
+
+	seq         int64 // 反映済みのイベントログの seq
+	snapshotSeq int64 // 最後にスナップショットを取った seq
+	updatedAt   int64 // 最後に反映したイベントの CreatedAt
+}
+
+func newRoomState(mItems map[int]game.MItem, t int64) *roomState {
+	return &roomState{State: game.NewState(mItems, t)}
+}
+
+// rs のルールで部屋を作る。rs が nil なら既定のルールを使う
+func newRoomStateWithRuleset(rs *roomRuleset, t int64) *roomState {
+	if rs == nil {
+		return newRoomState(currentItems(), t)
+	}
+	return &roomState{State: game.NewStateWithRules(rs.rules(), t), ruleset: rs, horizon: rs.Horizon}
+}
+
+// 部屋を作り直す。イベントログの位置はそのまま
+func (s *roomState) replace(x *roomState) {
+	seq, snapshotSeq, updatedAt := s.seq, s.snapshotSeq, s.updatedAt
+	*s = *x
+	s.seq, s.snapshotSeq, s.updatedAt = seq, snapshotSeq, updatedAt
+}
+
+// イベントログの1件を反映する
+func (s *roomState) apply(e RoomEvent) {
+	switch e.Type {
+	case eventIsuAdded:
+		s.AddIsu(e.Time, game.Str2Big(e.Isu))
+		s.started = true
+	case eventItemBought:
+		s.Buy(game.Buying{RoomName: e.RoomName, ItemID: e.ItemID, Ordinal: e.Ordinal, Time: e.Time})
+		s.started = true
+	case eventItemSold:
+		s.Sell(game.Selling{RoomName: e.RoomName, ItemID: e.ItemID, Ordinal: e.Ordinal, Time: e.Time, Refund: e.Isu})
+		s.started = true
+	case eventHorizonSet:
+		s.horizon = e.Horizon
+	case eventRulesetSet:
+		rs, err := parseRoomRuleset(e.Ruleset)
+		if err != nil {
+			logger.Error("failed to parse ruleset", "room", e.RoomName, "seq", e.Seq, "err", err)
+		}
+		s.replace(newRoomStateWithRuleset(rs, e.Time))
+	case eventRoomReset:
+		// リセットした部屋は既定のルールに戻る。Ruleset にはその時点のアイテムが入っている
+		rs, err := parseRoomRuleset(e.Ruleset)
+		if err != nil {
+			logger.Error("failed to parse ruleset", "room", e.RoomName, "seq", e.Seq, "err", err)
+		}
+		s.replace(newRoomStateWithRuleset(rs, e.Time))
+	}
+	// まだ追記していないイベントには seq が無いので、record で振られた seq にする
+	if e.Seq != 0 {
+		s.seq = e.Seq
+	}
+	s.updatedAt = e.CreatedAt
+}
+
+// 最後のイベントより後に全ての部屋をリセットしていれば、リセットした時刻の RoomReset を返す
+func (s *roomState) pendingReset(lastReset int64) (RoomEvent, bool) {
+	if s.seq == 0 || lastReset <= s.updatedAt {
+		return RoomEvent{}, false
+	}
+	return RoomEvent{Type: eventRoomReset, Time: lastReset, CreatedAt: lastReset}, true
+}
+
+// 部屋の既定の先読み時間で GameStatus を計算する
+func (s *roomState) status() *game.Status {
+	return s.Status(s.statusHorizon(0))
+}
+
+// 先読みするミリ秒数を返す。requested が 0 なら部屋の設定、
+// 部屋の設定も無ければサーバーの既定値を使い、サーバーの上限で切り詰める
+func (s *roomState) statusHorizon(requested int64) int64 {
+	horizon := requested
+	if horizon <= 0 {
+		horizon = s.horizon
+	}
+	if horizon <= 0 {
+		horizon = time.Duration(currentConfig().StatusHorizon).Milliseconds()
+	}
+	if max := time.Duration(currentConfig().MaxStatusHorizon).Milliseconds(); max < horizon {
+		horizon = max
+	}
+	return horizon
+}
+
+// プロセス内にキャッシュしている部屋の状態。
+// 部屋ごとの操作は mu で直列化される
+type cachedRoom struct {
+	mu    sync.Mutex
+	state *roomState
+}
+
+var roomStates = struct {
+	sync.Mutex
+	m map[string]*cachedRoom
+}{m: map[string]*cachedRoom{}}
+
+// キャッシュ済みの部屋を返す。無ければイベントログか store から読み込み、
+// 時刻 currentTime まで進めておく
+func lockRoomState(roomName string, currentTime int64) (*cachedRoom, error) {
+	roomStates.Lock()
+	r, ok := roomStates.m[roomName]
+	if !ok {
+		r = &cachedRoom{}
+		roomStates.m[roomName] = r
+	}
+	roomStates.Unlock()
+
+	r.mu.Lock()
+	if err := r.refresh(roomName, currentTime); err != nil {
+		r.state = nil
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.state.Advance(currentTime)
+	return r, nil
+}
+
+// キャッシュが無ければイベントログから読み込み、あれば他のプロセスが追記したイベントと
+// 他のプロセスで受け付けた /initialize を反映する。同じ MySQL を使う複数のプロセスが
+// 同じ部屋を操作しても、操作は常にイベントログの最新の状態に対して検証する
+func (r *cachedRoom) refresh(roomName string, currentTime int64) error {
+	if r.state == nil {
+		state, err := loadRoomState(roomName, currentTime)
+		if err != nil {
+			return err
+		}
+		r.state = state
+	} else {
+		events, err := eventLog.Events(roomName, r.state.seq)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			r.state.apply(e)
+		}
+	}
+
+	lastReset, err := eventLog.LastReset()
+	if err != nil {
+		return err
+	}
+	e, ok := r.state.pendingReset(lastReset)
+	if !ok {
+		return nil
+	}
+	// resetRoomStates は部屋ごとには追記しないので、次に読み込んだときに
+	// その時点のアイテムと一緒に追記する
+	b, err := json.Marshal(defaultRoomRuleset(currentItems()))
+	if err != nil {
+		return err
+	}
+	e.Ruleset = string(b)
+	r.state.apply(e)
+	return r.record(roomName, e)
+}
+
+// 部屋の時計は進めずに、今の時刻から見た部屋を返す。読むだけの API で使う。
+// 何も記録されていない部屋なら errRoomNotFound を返す
+func lockRoomStateForRead(roomName string) (*cachedRoom, error) {
+	// 知らない部屋名で読まれるたびにキャッシュが増えないように、無い部屋は読み込まない
+	roomStates.Lock()
+	_, ok := roomStates.m[roomName]
+	roomStates.Unlock()
+	if !ok {
+		exists, err := roomExists(roomName)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, errRoomNotFound
+		}
+	}
+
+	r, err := lockRoomState(roomName, getCurrentTime())
+	if err != nil {
+		return nil, err
+	}
+	if !r.state.started && r.state.seq == 0 {
+		r.mu.Unlock()
+		return nil, errRoomNotFound
+	}
+	return r, nil
+}
+
+// イベントログか store に部屋があるかを、キャッシュにも store にも部屋を作らずに確かめる
+func roomExists(roomName string) (bool, error) {
+	snap, err := eventLog.LatestSnapshot(roomName)
+	if err != nil {
+		return false, err
+	}
+	if snap != nil {
+		return true, nil
+	}
+	// スナップショットが無ければイベントは SnapshotInterval 件未満なので、全部読んでもよい
+	events, err := eventLog.Events(roomName, 0)
+	if err != nil {
+		return false, err
+	}
+	if 0 < len(events) {
+		return true, nil
+	}
+
+	addings, err := store.LoadAddings(roomName)
+	if err != nil {
+		return false, err
+	}
+	buyings, err := store.LoadBuyings(roomName)
+	if err != nil {
+		return false, err
+	}
+	sellings, err := store.LoadSellings(roomName)
+	if err != nil {
+		return false, err
+	}
+	return 0 < len(addings)+len(buyings)+len(sellings), nil
+}
+
+// イベントログから部屋を作る。イベントログに無い部屋は、イベントログができる前に
+// store に保存した adding, buying と selling をイベントとして追記してから作るので、
+// 以後はイベントログだけを見ればよい
+func loadRoomState(roomName string, currentTime int64) (*roomState, error) {
+	state, err := rebuildRoomState(roomName)
+	if err != nil || state != nil {
+		return state, err
+	}
+
+	state = newRoomState(currentItems(), 0)
+	events, err := storeEvents(roomName, currentTime)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return state, nil
+	}
+
+	for _, e := range events {
+		state.apply(e)
+	}
+	r := &cachedRoom{state: state}
+	if err := r.record(roomName, events...); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// store にある部屋の adding, buying と selling を、game.ReplayWithSellings と同じ順のイベントにする
+func storeEvents(roomName string, currentTime int64) ([]RoomEvent, error) {
+	addings, err := store.LoadAddings(roomName)
+	if err != nil {
+		return nil, err
+	}
+	buyings, err := store.LoadBuyings(roomName)
+	if err != nil {
+		return nil, err
+	}
+	sellings, err := store.LoadSellings(roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []RoomEvent{}
+	for _, a := range addings {
+		events = append(events, RoomEvent{Type: eventIsuAdded, Time: a.Time, Isu: a.Isu, CreatedAt: currentTime})
+	}
+	for _, b := range buyings {
+		events = append(events, RoomEvent{Type: eventItemBought, Time: b.Time, ItemID: b.ItemID, Ordinal: b.Ordinal, CreatedAt: currentTime})
+	}
+	// 売ったアイテムは buying に無いので、BoughtTime に買ったものとする
+	for _, sl := range sellings {
+		events = append(events, RoomEvent{Type: eventItemBought, Time: sl.BoughtTime, ItemID: sl.ItemID, Ordinal: sl.Ordinal, CreatedAt: currentTime})
+	}
+	for _, sl := range sellings {
+		events = append(events, RoomEvent{Type: eventItemSold, Time: sl.Time, Isu: sl.Refund, ItemID: sl.ItemID, Ordinal: sl.Ordinal, CreatedAt: currentTime})
+	}
+	return events, nil
+}
+
+// 全ての部屋を空にする。部屋の数によらないように、イベントログにはリセットした時刻だけを残し、
+// 各部屋の RoomReset は次に読み込むときに追記する
+func resetRoomStates(currentTime int64) error {
+	if err := eventLog.MarkReset(currentTime); err != nil {
+		return err
+	}
+	roomStates.Lock()
+	roomStates.m = map[string]*cachedRoom{}
+	roomStates.Unlock()
+	return nil
+}
+
+// スナップショットとして保存する roomState
+type roomStateSnapshot struct {
+	game.Snapshot
+	Ruleset   *roomRuleset `json:"ruleset,omitempty"`
+	Horizon   int64        `json:"horizon,omitempty"`
+	Started   bool         `json:"started,omitempty"`
+	UpdatedAt int64        `json:"updated_at,omitempty"`
+}
+
+func (s *roomState) snapshot(roomName string) (RoomSnapshot, error) {
+	state, err := json.Marshal(roomStateSnapshot{
+		Snapshot:  s.Snapshot(),
+		Ruleset:   s.ruleset,
+		Horizon:   s.horizon,
+		Started:   s.started,
+		UpdatedAt: s.updatedAt,
+	})
+	if err != nil {
+		return RoomSnapshot{}, err
+	}
+	return RoomSnapshot{
+		RoomName: roomName,
+		Seq:      s.seq,
+		Time:     s.Time(),
+		State:    string(state),
+	}, nil
+}
+
+func restoreRoomState(mItems map[int]game.MItem, snap *RoomSnapshot) (*roomState, error) {
+	var x roomStateSnapshot
+	err := json.Unmarshal([]byte(snap.State), &x)
+	if err != nil {
+		return nil, err
+	}
+	rules := game.Rules{Items: mItems}
+	if x.Ruleset != nil {
+		if err := x.Ruleset.resolve(); err != nil {
+			return nil, err
+		}
+		rules = x.Ruleset.rules()
+	}
+	return &roomState{
+		State:       game.Restore(rules, x.Snapshot),
+		ruleset:     x.Ruleset,
+		horizon:     x.Horizon,
+		started:     x.Started,
+		seq:         snap.Seq,
+		snapshotSeq: snap.Seq,
+		updatedAt:   x.UpdatedAt,
+	}, nil
+}
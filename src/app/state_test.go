@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"app/game"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusHorizon(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newRoomState(currentItems(), 0)
+	s.AddIsu(0, big.NewInt(1))
+	s.Buy(game.Buying{ItemID: 1, Ordinal: 1, Time: 0})
+	s.AddIsu(2500, big.NewInt(3))
+
+	assert.Equal(int64(1000), s.statusHorizon(0))
+	assert.Equal(int64(5000), s.statusHorizon(5000))
+	assert.Equal(time.Duration(currentConfig().MaxStatusHorizon).Milliseconds(), s.statusHorizon(1<<40))
+	s.horizon = 3000
+	assert.Equal(int64(3000), s.statusHorizon(0))
+
+	status := s.status()
+	assert.Equal(s.Status(3000), status)
+	assert.Equal(int64(2500), status.Schedule[len(status.Schedule)-1].Time)
+}
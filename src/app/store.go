@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+
+	"app/game"
+)
+
+var errAlreadyBought = errors.New("already bought")
+
+// 部屋ごとの adding, buying と selling の保存先
+type RoomStore interface {
+	// 部屋の adding を全て返す。順序は保証しない
+	LoadAddings(roomName string) ([]game.Adding, error)
+	// 部屋の buying を全て返す。順序は保証しない
+	LoadBuyings(roomName string) ([]game.Buying, error)
+	// 時刻 reqTime の adding に isu を足す。無ければ作る
+	AddIsu(roomName string, reqTime int64, isu *big.Int) error
+	// buying を追加する。同じアイテムを b.Ordinal-1 個買っていなければ errAlreadyBought を返す
+	InsertBuying(roomName string, b game.Buying) error
+	// bs をまとめて追加する。1 件でも InsertBuying の条件を満たさなければ何も追加せず errAlreadyBought を返す。
+	// bs の中で同じアイテムを続けて買うときは Ordinal を 1 ずつ増やす
+	InsertBuyings(roomName string, bs []game.Buying) error
+	// 部屋の selling を全て返す。順序は保証しない
+	LoadSellings(roomName string) ([]game.Selling, error)
+	// 同じアイテムの最後の buying を消して sl を追加する。BoughtTime は消した buying の Time にする。
+	// 同じアイテムを sl.Ordinal 個買っていなければ errAlreadyBought を返す
+	InsertSelling(roomName string, sl game.Selling) error
+	// 全ての部屋を消す
+	Reset() error
+}
+
+var store RoomStore
+
+// store はイベントログを追記した後に書く履歴の写しで、部屋の状態には使わない。
+// 書けなくても操作は受け付け済みなので、ログに残すだけにする
+func mirrorToStore(roomName string, err error) {
+	if err != nil {
+		logger.Error("failed to write store", "room", roomName, "err", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+
+	"app/game"
+)
+
+// MySQL を使わずにプロセス内で完結する RoomStore
+type memoryStore struct {
+	mu    sync.Mutex
+	rooms map[string]*memoryRoom
+}
+
+type memoryRoom struct {
+	addings  map[int64]*big.Int // Time => Isu
+	buyings  []game.Buying
+	sellings []game.Selling
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{rooms: map[string]*memoryRoom{}}
+}
+
+// 読むだけなら部屋を作らない
+func (s *memoryStore) lookup(roomName string) *memoryRoom {
+	if r, ok := s.rooms[roomName]; ok {
+		return r
+	}
+	return &memoryRoom{addings: map[int64]*big.Int{}}
+}
+
+func (s *memoryStore) room(roomName string) *memoryRoom {
+	r, ok := s.rooms[roomName]
+	if !ok {
+		r = &memoryRoom{addings: map[int64]*big.Int{}}
+		s.rooms[roomName] = r
+	}
+	return r
+}
+
+func (s *memoryStore) LoadAddings(roomName string) ([]game.Adding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.lookup(roomName)
+	addings := make([]game.Adding, 0, len(r.addings))
+	for t, isu := range r.addings {
+		addings = append(addings, game.Adding{RoomName: roomName, Time: t, Isu: isu.String()})
+	}
+	return addings, nil
+}
+
+func (s *memoryStore) LoadBuyings(roomName string) ([]game.Buying, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.lookup(roomName)
+	buyings := make([]game.Buying, len(r.buyings))
+	copy(buyings, r.buyings)
+	return buyings, nil
+}
+
+func (s *memoryStore) AddIsu(roomName string, reqTime int64, isu *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.room(roomName)
+	if cur, ok := r.addings[reqTime]; ok {
+		cur.Add(cur, isu)
+	} else {
+		r.addings[reqTime] = new(big.Int).Set(isu)
+	}
+	return nil
+}
+
+func (s *memoryStore) InsertBuying(roomName string, b game.Buying) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.room(roomName)
+	count := 0
+	for _, x := range r.buyings {
+		if x.ItemID == b.ItemID {
+			count++
+		}
+	}
+	if count != b.Ordinal-1 {
+		return errAlreadyBought
+	}
+	b.RoomName = roomName
+	r.buyings = append(r.buyings, b)
+	return nil
+}
+
+func (s *memoryStore) InsertBuyings(roomName string, bs []game.Buying) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.room(roomName)
+	counts := map[int]int{}
+	for _, x := range r.buyings {
+		counts[x.ItemID]++
+	}
+	for _, b := range bs {
+		if counts[b.ItemID] != b.Ordinal-1 {
+			return errAlreadyBought
+		}
+		counts[b.ItemID]++
+	}
+	for _, b := range bs {
+		b.RoomName = roomName
+		r.buyings = append(r.buyings, b)
+	}
+	return nil
+}
+
+func (s *memoryStore) LoadSellings(roomName string) ([]game.Selling, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.lookup(roomName)
+	sellings := make([]game.Selling, len(r.sellings))
+	copy(sellings, r.sellings)
+	return sellings, nil
+}
+
+func (s *memoryStore) InsertSelling(roomName string, sl game.Selling) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.room(roomName)
+	count, last := 0, -1
+	for i, x := range r.buyings {
+		if x.ItemID == sl.ItemID {
+			count++
+			if x.Ordinal == sl.Ordinal {
+				last = i
+			}
+		}
+	}
+	if count != sl.Ordinal || last < 0 {
+		return errAlreadyBought
+	}
+	sl.RoomName = roomName
+	sl.BoughtTime = r.buyings[last].Time
+	r.buyings = append(r.buyings[:last], r.buyings[last+1:]...)
+	r.sellings = append(r.sellings, sl)
+	return nil
+}
+
+func (s *memoryStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rooms = map[string]*memoryRoom{}
+	return nil
+}
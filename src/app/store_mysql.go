@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math/big"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+
+	"app/game"
+)
+
+// adding, buying, selling テーブルを使う RoomStore
+type mysqlStore struct {
+	db *sqlx.DB
+}
+
+func newMySQLStore(db *sqlx.DB) (*mysqlStore, error) {
+	var addings []game.Adding
+	err := db.Select(&addings, "SELECT * FROM adding")
+	if err != nil {
+		return nil, err
+	}
+	for _, adding := range addings {
+		addReqCh <- IsuReq{adding.RoomName, adding.Time, nil}
+	}
+	return &mysqlStore{db: db}, nil
+}
+
+func (s *mysqlStore) LoadAddings(roomName string) ([]game.Adding, error) {
+	addings := []game.Adding{}
+	err := s.db.Select(&addings, "SELECT time, isu FROM adding WHERE room_name = ?", roomName)
+	return addings, err
+}
+
+func (s *mysqlStore) LoadBuyings(roomName string) ([]game.Buying, error) {
+	buyings := []game.Buying{}
+	err := s.db.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
+	return buyings, err
+}
+
+func (s *mysqlStore) AddIsu(roomName string, reqTime int64, reqIsu *big.Int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan bool)
+	testReqCh <- IsuReq{roomName, reqTime, ch}
+	exist := <-ch
+	if exist {
+		var isuStr string
+		err = tx.QueryRow("SELECT isu FROM adding WHERE room_name = ? AND time = ? FOR UPDATE", roomName, reqTime).Scan(&isuStr)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		isu := game.Str2Big(isuStr)
+
+		isu.Add(isu, reqIsu)
+		_, err = tx.Exec("UPDATE adding SET isu = ? WHERE room_name = ? AND time = ?", isu.String(), roomName, reqTime)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	} else {
+		_, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE isu=isu", roomName, reqTime, reqIsu.String())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		addReqCh <- IsuReq{roomName, reqTime, nil}
+	}
+
+	return tx.Commit()
+}
+
+func (s *mysqlStore) InsertBuying(roomName string, b game.Buying) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var countBuying int
+	err = tx.Get(&countBuying, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ? FOR UPDATE", roomName, b.ItemID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if countBuying != b.Ordinal-1 {
+		tx.Rollback()
+		return errAlreadyBought
+	}
+
+	_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", roomName, b.ItemID, b.Ordinal, b.Time)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *mysqlStore) InsertBuyings(roomName string, bs []game.Buying) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	counts := map[int]int{}
+	for _, b := range bs {
+		count, ok := counts[b.ItemID]
+		if !ok {
+			err = tx.Get(&count, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ? FOR UPDATE", roomName, b.ItemID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if count != b.Ordinal-1 {
+			tx.Rollback()
+			return errAlreadyBought
+		}
+		counts[b.ItemID] = count + 1
+
+		_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", roomName, b.ItemID, b.Ordinal, b.Time)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *mysqlStore) LoadSellings(roomName string) ([]game.Selling, error) {
+	sellings := []game.Selling{}
+	err := s.db.Select(&sellings, "SELECT item_id, ordinal, bought_time, time, refund FROM selling WHERE room_name = ?", roomName)
+	return sellings, err
+}
+
+func (s *mysqlStore) InsertSelling(roomName string, sl game.Selling) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var countBuying int
+	err = tx.Get(&countBuying, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ? FOR UPDATE", roomName, sl.ItemID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if countBuying != sl.Ordinal {
+		tx.Rollback()
+		return errAlreadyBought
+	}
+
+	err = tx.Get(&sl.BoughtTime, "SELECT time FROM buying WHERE room_name = ? AND item_id = ? AND ordinal = ?", roomName, sl.ItemID, sl.Ordinal)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM buying WHERE room_name = ? AND item_id = ? AND ordinal = ?", roomName, sl.ItemID, sl.Ordinal)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO selling(room_name, item_id, ordinal, bought_time, time, refund) VALUES(?, ?, ?, ?, ?, ?)",
+		roomName, sl.ItemID, sl.Ordinal, sl.BoughtTime, sl.Time, sl.Refund)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *mysqlStore) Reset() error {
+	for _, table := range []string{"adding", "buying", "selling"} {
+		if _, err := s.db.Exec("TRUNCATE TABLE " + table); err != nil {
+			return err
+		}
+	}
+	initCh <- struct{}{}
+	return nil
+}
+
+type IsuReq struct {
+	roomName string
+	reqTime  int64
+	ch       chan bool
+}
+
+var addReqCh = make(chan IsuReq, 0)
+var testReqCh = make(chan IsuReq, 0)
+var initCh = make(chan struct{}, 0)
+
+// 部屋と時刻ごとに adding が既に存在するかを覚えておく
+func isuFilterHandler() {
+	filters := make(map[string]map[int64]struct{})
+	for {
+		select {
+		case addReq := <-addReqCh:
+			if _, ok := filters[addReq.roomName]; !ok {
+				filters[addReq.roomName] = make(map[int64]struct{})
+			}
+			filters[addReq.roomName][addReq.reqTime] = struct{}{}
+		case testReq := <-testReqCh:
+			if _, ok := filters[testReq.roomName]; !ok {
+				filters[testReq.roomName] = make(map[int64]struct{})
+			}
+			_, ok := filters[testReq.roomName][testReq.reqTime]
+			testReq.ch <- ok
+		case <-initCh:
+			filters = make(map[string]map[int64]struct{})
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"app/game"
+)
+
+func TestMemoryStoreAdding(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newMemoryStore()
+	assert.Nil(s.AddIsu("a", 100, big.NewInt(1)))
+	assert.Nil(s.AddIsu("a", 100, game.Str2Big("1234567890123456789")))
+	assert.Nil(s.AddIsu("a", 200, big.NewInt(3)))
+	assert.Nil(s.AddIsu("b", 100, big.NewInt(5)))
+
+	addings, err := s.LoadAddings("a")
+	assert.Nil(err)
+	assert.Len(addings, 2)
+	assert.Contains(addings, game.Adding{RoomName: "a", Time: 100, Isu: "1234567890123456790"})
+	assert.Contains(addings, game.Adding{RoomName: "a", Time: 200, Isu: "3"})
+
+	assert.Nil(s.Reset())
+	addings, err = s.LoadAddings("a")
+	assert.Nil(err)
+	assert.Empty(addings)
+}
+
+func TestMemoryStoreBuying(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newMemoryStore()
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 1, Time: 100}))
+	assert.Equal(errAlreadyBought, s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 1, Time: 200}))
+	assert.Equal(errAlreadyBought, s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 3, Time: 200}))
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 2, Time: 200}))
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 2, Ordinal: 1, Time: 200}))
+
+	buyings, err := s.LoadBuyings("a")
+	assert.Nil(err)
+	assert.Len(buyings, 3)
+
+	buyings, err = s.LoadBuyings("b")
+	assert.Nil(err)
+	assert.Empty(buyings)
+}
+
+// まとめて追加するときは 1 件でも条件を満たさなければ何も追加しない
+func TestMemoryStoreInsertBuyings(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newMemoryStore()
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 1, Time: 100}))
+	assert.Equal(errAlreadyBought, s.InsertBuyings("a", []game.Buying{
+		{ItemID: 1, Ordinal: 2, Time: 200},
+		{ItemID: 2, Ordinal: 1, Time: 200},
+		{ItemID: 1, Ordinal: 2, Time: 200},
+	}))
+	buyings, err := s.LoadBuyings("a")
+	assert.Nil(err)
+	assert.Len(buyings, 1)
+
+	assert.Nil(s.InsertBuyings("a", []game.Buying{
+		{ItemID: 1, Ordinal: 2, Time: 200},
+		{ItemID: 2, Ordinal: 1, Time: 200},
+		{ItemID: 1, Ordinal: 3, Time: 200},
+	}))
+	buyings, err = s.LoadBuyings("a")
+	assert.Nil(err)
+	assert.Len(buyings, 4)
+}
+
+// 売ったものは buying から selling に移り、同じ Ordinal をまた買える
+func TestMemoryStoreInsertSelling(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newMemoryStore()
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 1, Time: 100}))
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 2, Time: 200}))
+	assert.Equal(errAlreadyBought, s.InsertSelling("a", game.Selling{ItemID: 1, Ordinal: 1, Time: 300, Refund: "1"}))
+	assert.Equal(errAlreadyBought, s.InsertSelling("a", game.Selling{ItemID: 2, Ordinal: 1, Time: 300, Refund: "1"}))
+	assert.Nil(s.InsertSelling("a", game.Selling{ItemID: 1, Ordinal: 2, Time: 300, Refund: "1"}))
+
+	buyings, err := s.LoadBuyings("a")
+	assert.Nil(err)
+	assert.Len(buyings, 1)
+	sellings, err := s.LoadSellings("a")
+	assert.Nil(err)
+	assert.Equal([]game.Selling{{RoomName: "a", ItemID: 1, Ordinal: 2, BoughtTime: 200, Time: 300, Refund: "1"}}, sellings)
+
+	assert.Nil(s.InsertBuying("a", game.Buying{ItemID: 1, Ordinal: 2, Time: 400}))
+}